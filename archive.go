@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// archiveFileName is the file in each user's game directory holding the
+// games exactly as lichess sent them, one JSON object per line.
+const archiveFileName = "games.ndjson"
+
+// maxArchiveLine bounds a single game, which grows large with analysis
+const maxArchiveLine = 4 * 1024 * 1024
+
+func archivePath(userGames string) string {
+	return filepath.Join(userGames, archiveFileName)
+}
+
+// appendToArchive adds the raw JSON of a game to the end of the archive
+func appendToArchive(path string, gameBytes []byte) error {
+	archive, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	// gameBytes may be the buffer of a scanner, which must not be written to
+	_, err = archive.Write(slices.Concat(gameBytes, []byte{'\n'}))
+	if err != nil {
+		archive.Close()
+		return err
+	}
+	return archive.Close()
+}
+
+// readArchive decodes every game in an archive in the order they were
+// downloaded. A missing archive holds no games.
+func readArchive(path string) (games []*Game, err error) {
+	archive, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+		return
+	}
+	if err != nil {
+		return
+	}
+	defer archive.Close()
+
+	scanner := bufio.NewScanner(archive)
+	scanner.Buffer(nil, maxArchiveLine)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		game := Game{}
+		err := json.Unmarshal(scanner.Bytes(), &game)
+		if err != nil {
+			log.Printf("%s:%d | Skipping game: %v\n", path, line, err)
+			continue
+		}
+		games = append(games, &game)
+	}
+	err = scanner.Err()
+	return
+}
+
+// pgnFileName is the name of the PGN file a downloaded game is written to
+func (g *Game) pgnFileName() string {
+	gameYear, gameMonth, gameDay := time.UnixMilli(g.CreatedAt).Date()
+	gameDate := fmt.Sprintf("%d.%d.%d", gameYear, gameMonth, gameDay)
+	return fmt.Sprintf("%s_%s.pgn", gameDate, g.ID)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/theMagicRabbit/lichan/internal/config"
+)
+
+// oauthClientID identifies lichan to lichess, which needs no registration
+const oauthClientID = "lichan"
+
+// oauthScopes are all lichan needs: downloading games needs no scope, and
+// pushing to a study reads and writes it.
+var oauthScopes = []string{"study:read", "study:write"}
+
+// loginTimeout is how long the browser has to come back after lichess
+const loginTimeout = 5 * time.Minute
+
+// handlerLogin asks lichess for a token in the browser and saves it to the
+// credentials file, where it is used instead of the pat of the config.
+func (s *state) handlerLogin() error {
+	ctx, cancel := context.WithTimeout(context.Background(), loginTimeout)
+	defer cancel()
+	credentials, err := s.login(ctx, openBrowser)
+	if err != nil {
+		return err
+	}
+	err = credentials.Write(s.CredentialsPath)
+	if err != nil {
+		return err
+	}
+	s.Lichess.Token = credentials.Token
+	log.Printf("Logged in, token saved to %s\n", s.CredentialsPath)
+	return nil
+}
+
+// login runs the OAuth2 authorization code flow with PKCE. The user grants
+// access at authorizeURL, opened with open, and lichess sends the browser
+// back to a server on the loopback interface with the code.
+func (s *state) login(ctx context.Context, open func(authorizeURL string) error) (credentials config.Credentials, err error) {
+	verifier, err := randomString()
+	if err != nil {
+		return
+	}
+	loginState, err := randomString()
+	if err != nil {
+		return
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	redirectURI := fmt.Sprintf("http://%s/callback", listener.Addr())
+
+	type callback struct {
+		code string
+		err  error
+	}
+	callbacks := make(chan callback, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/callback" {
+			http.NotFound(w, r)
+			return
+		}
+		query := r.URL.Query()
+		if query.Get("state") != loginState {
+			// Not the answer to this login, which keeps waiting for it
+			http.Error(w, "Unknown login", http.StatusBadRequest)
+			return
+		}
+		var result callback
+		switch {
+		case query.Get("error") != "":
+			result.err = fmt.Errorf("Login refused: %s %s", query.Get("error"), query.Get("error_description"))
+		case query.Get("code") == "":
+			result.err = errors.New("Login answered without a code")
+		default:
+			result.code = query.Get("code")
+		}
+		if result.err != nil {
+			http.Error(w, result.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "Logged in to lichan, this window can be closed.")
+		}
+		select {
+		case callbacks <- result:
+		default:
+		}
+	})}
+	go server.Serve(listener)
+	defer server.Close()
+
+	query := url.Values{}
+	query.Set("response_type", "code")
+	query.Set("client_id", oauthClientID)
+	query.Set("redirect_uri", redirectURI)
+	query.Set("code_challenge_method", "S256")
+	query.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	query.Set("scope", strings.Join(oauthScopes, " "))
+	query.Set("state", loginState)
+	authorizeURL := s.SiteUrl + "/oauth?" + query.Encode()
+
+	fmt.Printf("Grant lichan access on lichess at:\n%s\n", authorizeURL)
+	if err := open(authorizeURL); err != nil {
+		log.Printf("Unable to open a browser: %v\n", err)
+	}
+
+	var result callback
+	select {
+	case result = <-callbacks:
+	case <-ctx.Done():
+		err = fmt.Errorf("No answer from lichess: %w", ctx.Err())
+		return
+	}
+	if result.err != nil {
+		err = result.err
+		return
+	}
+	return s.requestToken(ctx, result.code, verifier, redirectURI)
+}
+
+// requestToken trades the code of a login for a token
+func (s *state) requestToken(ctx context.Context, code, verifier, redirectURI string) (credentials config.Credentials, err error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("code_verifier", verifier)
+	form.Set("redirect_uri", redirectURI)
+	form.Set("client_id", oauthClientID)
+
+	// The code is the only credential of this request
+	client := *s.Lichess
+	client.Token = ""
+	req, err := client.NewRequest(ctx, http.MethodPost, "/api/token", nil, strings.NewReader(form.Encode()))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	err = json.NewDecoder(res.Body).Decode(&token)
+	if err != nil {
+		return
+	}
+	if token.AccessToken == "" {
+		err = errors.New("Lichess sent no token")
+		return
+	}
+	credentials.Token = token.AccessToken
+	credentials.Scopes = oauthScopes
+	if token.ExpiresIn > 0 {
+		credentials.Expires = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second).UnixMilli()
+	}
+	return
+}
+
+// handlerLogout revokes the token of the last login and removes the
+// credentials file. A pat in the config is left alone.
+func (s *state) handlerLogout() error {
+	credentials, err := config.ReadCredentials(s.CredentialsPath)
+	if err != nil {
+		return err
+	}
+	if credentials.Token == "" {
+		log.Println("Not logged in")
+		return nil
+	}
+
+	client := *s.Lichess
+	client.Token = credentials.Token
+	req, err := client.NewRequest(context.Background(), http.MethodDelete, "/api/token", nil, nil)
+	if err != nil {
+		return err
+	}
+	res, err := client.Do(req)
+	if err == nil {
+		res.Body.Close()
+	} else if errors.Is(err, ErrUnauthorized) {
+		// The token has expired or was revoked on lichess already
+		log.Printf("Token was no longer valid: %v\n", err)
+	} else {
+		return fmt.Errorf("unable to revoke token: %w", err)
+	}
+
+	err = os.Remove(s.CredentialsPath)
+	if err != nil {
+		return err
+	}
+	log.Println("Logged out")
+	return nil
+}
+
+// randomString returns 32 random bytes as unpadded base64url, the form
+// PKCE expects of a code verifier.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// openBrowser shows a URL in the user's browser
+func openBrowser(u string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", u)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", u)
+	default:
+		cmd = exec.Command("xdg-open", u)
+	}
+	return cmd.Start()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMagicRabbit/lichan/internal/config"
+)
+
+// fakeAuthServer grants tokens like the lichess OAuth2 endpoints. Answer
+// decides how the authorization page answers: "grant" or "deny".
+type fakeAuthServer struct {
+	Answer    string
+	challenge string
+	redirect  string
+	Revoked   []string
+}
+
+func (f *fakeAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/oauth":
+		query := r.URL.Query()
+		if query.Get("client_id") != oauthClientID || query.Get("response_type") != "code" ||
+			query.Get("code_challenge_method") != "S256" || query.Get("scope") != "study:read study:write" {
+			http.Error(w, "bad authorization request", http.StatusBadRequest)
+			return
+		}
+		f.challenge = query.Get("code_challenge")
+		f.redirect = query.Get("redirect_uri")
+		answer := url.Values{}
+		answer.Set("state", query.Get("state"))
+		switch f.Answer {
+		case "grant":
+			answer.Set("code", "authcode")
+		case "deny":
+			answer.Set("error", "access_denied")
+		}
+		http.Redirect(w, r, f.redirect+"?"+answer.Encode(), http.StatusFound)
+	case r.URL.Path == "/api/token" && r.Method == http.MethodPost:
+		r.ParseForm()
+		verified := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+		if r.Header.Get("Authorization") != "" || r.PostForm.Get("grant_type") != "authorization_code" ||
+			r.PostForm.Get("code") != "authcode" || r.PostForm.Get("redirect_uri") != f.redirect ||
+			base64.RawURLEncoding.EncodeToString(verified[:]) != f.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+		w.Write([]byte(`{"token_type":"Bearer","access_token":"lio_granted","expires_in":31536000}`))
+	case r.URL.Path == "/api/token" && r.Method == http.MethodDelete:
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token != "lio_granted" || slices.Contains(f.Revoked, token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"No such token"}`))
+			return
+		}
+		f.Revoked = append(f.Revoked, token)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestLogin(T *testing.T) {
+	tests := []struct {
+		Answer string
+		// Forge sends lichan an answer to another login first
+		Forge bool
+		Err   bool
+	}{
+		{Answer: "grant"},
+		{Answer: "deny", Err: true},
+		{Answer: "grant", Forge: true},
+	}
+
+	for _, test := range tests {
+		auth := &fakeAuthServer{Answer: test.Answer}
+		server := httptest.NewServer(auth)
+		s := state{
+			ApiUrl:          server.URL,
+			SiteUrl:         server.URL,
+			Lichess:         NewLichessClient(server.URL, "pat"),
+			CredentialsPath: filepath.Join(T.TempDir(), "lichan", "credentials.toml"),
+		}
+		s.Lichess.MaxRetries = 0
+
+		// The browser follows the redirect back to lichan
+		browse := func(authorizeURL string) error {
+			if test.Forge {
+				u, _ := url.Parse(authorizeURL)
+				forged, err := http.Get(u.Query().Get("redirect_uri") + "?state=forged&code=stolen")
+				if err != nil {
+					return err
+				}
+				forged.Body.Close()
+			}
+			res, err := http.Get(authorizeURL)
+			if err == nil {
+				res.Body.Close()
+			}
+			return err
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		credentials, err := s.login(ctx, browse)
+		cancel()
+		if test.Err {
+			if err == nil {
+				T.Errorf("%s: expected login to fail\n", test.Answer)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			T.Fatalf("%s: %v\n", test.Answer, err)
+		}
+		if credentials.Token != "lio_granted" || credentials.Expired() || !slices.Equal(credentials.Scopes, oauthScopes) {
+			T.Errorf("%s: got credentials %+v\n", test.Answer, credentials)
+		}
+
+		err = credentials.Write(s.CredentialsPath)
+		if err != nil {
+			T.Fatalf("%s: %v\n", test.Answer, err)
+		}
+		info, err := os.Stat(s.CredentialsPath)
+		if err != nil || info.Mode().Perm() != 0600 {
+			T.Errorf("%s: credentials file %v (%v), expected mode 0600\n", test.Answer, info, err)
+		}
+		saved, err := config.ReadCredentials(s.CredentialsPath)
+		if err != nil || saved.Token != "lio_granted" {
+			T.Errorf("%s: read back %+v (%v)\n", test.Answer, saved, err)
+		}
+
+		// Logging out revokes the token and forgets it, and logging out
+		// again has nothing to do
+		for range 2 {
+			err = s.handlerLogout()
+			if err != nil {
+				T.Errorf("%s: logout: %v\n", test.Answer, err)
+			}
+		}
+		if !slices.Equal(auth.Revoked, []string{"lio_granted"}) {
+			T.Errorf("%s: revoked %v\n", test.Answer, auth.Revoked)
+		}
+		if _, err := os.Stat(s.CredentialsPath); !errors.Is(err, os.ErrNotExist) {
+			T.Errorf("%s: credentials left after logout: %v\n", test.Answer, err)
+		}
+
+		// A token revoked on lichess is still forgotten
+		credentials.Write(s.CredentialsPath)
+		err = s.handlerLogout()
+		if _, statErr := os.Stat(s.CredentialsPath); err != nil || !errors.Is(statErr, os.ErrNotExist) {
+			T.Errorf("%s: logout of a revoked token: %v, %v\n", test.Answer, err, statErr)
+		}
+		server.Close()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// commandRE matches the [%cmd value] annotations embedded in PGN comments
+var commandRE = regexp.MustCompile(`\[%(\w+)\s+([^\]]*)\]`)
+
+// MoveAnalysis is the server analysis of a single ply as returned by the
+// lichess API. Eval is in centipawns from white's point of view.
+type MoveAnalysis struct {
+	Eval      *int   `json:"eval,omitempty"`
+	Mate      *int   `json:"mate,omitempty"`
+	Best      string `json:"best,omitempty"`
+	Variation string `json:"variation,omitempty"`
+	Judgment  *struct {
+		Name    string `json:"name"`
+		Comment string `json:"comment"`
+	} `json:"judgment,omitempty"`
+}
+
+// PlayerAnalysis summarises the mistakes of one player in an analysed game
+type PlayerAnalysis struct {
+	Inaccuracy int `json:"inaccuracy"`
+	Mistake    int `json:"mistake"`
+	Blunder    int `json:"blunder"`
+	ACPL       int `json:"acpl"`
+	Accuracy   int `json:"accuracy"`
+}
+
+// formatClock writes a clock in centiseconds as h:mm:ss
+func formatClock(centis int) string {
+	seconds := centis / 100
+	return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// parseClock reads a h:mm:ss clock, with optional fractions of a second,
+// as centiseconds.
+func parseClock(clock string) (centis int, err error) {
+	fields := strings.Split(strings.TrimSpace(clock), ":")
+	if len(fields) != 3 {
+		err = fmt.Errorf("Invalid clock: %s\n", clock)
+		return
+	}
+	hours, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return
+	}
+	minutes, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	seconds, err := strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return
+	}
+	centis = (hours*3600+minutes*60)*100 + int(math.Round(seconds*100))
+	return
+}
+
+// PGNEval writes the evaluation as a [%eval] value: pawns with two
+// decimals, or # and the moves to mate.
+func (a MoveAnalysis) PGNEval() string {
+	switch {
+	case a.Mate != nil:
+		return fmt.Sprintf("#%d", *a.Mate)
+	case a.Eval != nil:
+		return strconv.FormatFloat(float64(*a.Eval)/100, 'f', 2, 64)
+	}
+	return ""
+}
+
+func parseEval(eval string) (a MoveAnalysis, err error) {
+	eval = strings.TrimSpace(eval)
+	if mateIn, found := strings.CutPrefix(eval, "#"); found {
+		var mate int
+		mate, err = strconv.Atoi(mateIn)
+		a.Mate = &mate
+		return
+	}
+	pawns, err := strconv.ParseFloat(eval, 64)
+	if err != nil {
+		return
+	}
+	centipawns := int(math.Round(pawns * 100))
+	a.Eval = &centipawns
+	return
+}
+
+// readMoveTree fills the clocks and evaluations of the game from the main
+// line of its move tree.
+func (g *Game) readMoveTree() {
+	nodes := g.Tree.MainlineNodes()
+	var clocks []int
+	analysis := make([]MoveAnalysis, len(nodes))
+	hasEval := false
+	for i, node := range nodes {
+		if node.Clock != nil {
+			clocks = append(clocks, *node.Clock)
+		}
+		if node.Eval != nil {
+			analysis[i].Eval, analysis[i].Mate = node.Eval.Eval, node.Eval.Mate
+			hasEval = true
+		}
+	}
+	// Clocks only make sense with one for every move
+	if len(clocks) == len(nodes) && len(clocks) > 0 {
+		g.Clocks = clocks
+	}
+	if hasEval {
+		g.Analysis = analysis
+	}
+}
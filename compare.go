@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// evalDisagreement is how far apart the local and lichess evaluations of a
+// position may be, in winning chances from -1 to 1, before it is reported.
+// It is about 110cp in a level position and much more in a won one, and is
+// the drop lichess calls a mistake.
+const evalDisagreement = 0.2
+
+// comparisonFileName is the report of disagreements kept in each folder of
+// the engine directory
+const comparisonFileName = "lichess_comparison.txt"
+
+// EvalDiff is a move the local engine and lichess evaluate differently
+type EvalDiff struct {
+	Ply    int
+	Move   string
+	Server MoveAnalysis
+	Local  MoveAnalysis
+}
+
+func (d EvalDiff) String() string {
+	number := fmt.Sprintf("%d.", (d.Ply+1)/2)
+	if d.Ply%2 == 0 {
+		number = fmt.Sprintf("%d...", d.Ply/2)
+	}
+	return fmt.Sprintf("%s %s: lichess %s, local %s", number, d.Move, d.Server.PGNEval(), d.Local.PGNEval())
+}
+
+// winningChances scales an evaluation from white's point of view to
+// between -1 and 1 the way lichess does, so differences between won
+// positions count for less than differences between level ones.
+func winningChances(a MoveAnalysis) (chances float64, ok bool) {
+	switch {
+	case a.Mate != nil:
+		if *a.Mate < 0 {
+			return -1, true
+		}
+		return 1, true
+	case a.Eval != nil:
+		cp := math.Max(-1000, math.Min(1000, float64(*a.Eval)))
+		return 2/(1+math.Exp(-0.00368208*cp)) - 1, true
+	}
+	return
+}
+
+// hasServerAnalysis reports whether lichess sent evaluations with the game
+func (g *Game) hasServerAnalysis() bool {
+	for _, a := range g.Analysis {
+		if a.PGNEval() != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// compareAnalysis lists the moves whose local evaluation disagrees with
+// the one lichess sent. The local evaluations are those on the main line.
+func compareAnalysis(g *Game) (diffs []EvalDiff) {
+	ply := startingPly(g.InitalFEN)
+	for i, node := range g.MoveTree().MainlineNodes() {
+		if i >= len(g.Analysis) || node.Eval == nil {
+			continue
+		}
+		server, serverOk := winningChances(g.Analysis[i])
+		local, localOk := winningChances(*node.Eval)
+		if serverOk && localOk && math.Abs(server-local) >= evalDisagreement {
+			diffs = append(diffs, EvalDiff{Ply: ply + i + 1, Move: node.Move, Server: g.Analysis[i], Local: *node.Eval})
+		}
+	}
+	return
+}
+
+// reportComparison records the disagreements with lichess about a game in
+// the report in dir, replacing what an earlier analysis of the game found.
+// Each game is a heading followed by its moves and a blank line.
+func reportComparison(dir string, g *Game, diffs []EvalDiff) error {
+	heading := fmt.Sprintf("%s - %s", g.Players.White.User.Name, g.Players.Black.User.Name)
+	if g.ID != "" {
+		heading += fmt.Sprintf(" (%s)", g.ID)
+	}
+
+	reportPath := filepath.Join(dir, comparisonFileName)
+	old, err := os.ReadFile(reportPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var sb strings.Builder
+	for _, entry := range strings.SplitAfter(string(old), "\n\n") {
+		if entry != "" && !strings.HasPrefix(entry, heading+"\n") {
+			sb.WriteString(entry)
+		}
+	}
+	if len(diffs) > 0 {
+		sb.WriteString(heading + "\n")
+		for _, diff := range diffs {
+			fmt.Fprintf(&sb, "  %s\n", diff)
+		}
+		sb.WriteString("\n")
+	}
+	if sb.String() == string(old) {
+		return nil
+	}
+	return writeFileAtomic(reportPath, []byte(sb.String()))
+}
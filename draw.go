@@ -0,0 +1,77 @@
+package main
+
+type DrawReason string
+
+const (
+	NoDraw               DrawReason = ""
+	ThreefoldRepetition  DrawReason = "threefold repetition"
+	FivefoldRepetition   DrawReason = "fivefold repetition"
+	FiftyMoveRule        DrawReason = "fifty-move rule"
+	SeventyFiveMoveRule  DrawReason = "seventy-five-move rule"
+	InsufficientMaterial DrawReason = "insufficient material"
+	StalematePosition    DrawReason = "stalemate"
+)
+
+// RepetitionCount is the number of times the current position has occurred,
+// including the current occurrence.
+func (gs *GameState) RepetitionCount() int {
+	hash := gs.Hash()
+	count := 1
+	// Positions before the last capture or pawn move cannot repeat
+	for i := len(gs.History) - 1; i >= 0 && i >= len(gs.History)-gs.HalfmoveClock; i-- {
+		if gs.History[i] == hash {
+			count++
+		}
+	}
+	return count
+}
+
+func (gs *GameState) IsThreefoldRepetition() bool {
+	return gs.RepetitionCount() >= 3
+}
+
+func (gs *GameState) IsFivefoldRepetition() bool {
+	return gs.RepetitionCount() >= 5
+}
+
+func (gs *GameState) IsFiftyMoveRule() bool {
+	return gs.HalfmoveClock >= 100
+}
+
+func (gs *GameState) IsSeventyFiveMoveRule() bool {
+	return gs.HalfmoveClock >= 150
+}
+
+// IsDeadPosition reports positions where neither side can win by any
+// sequence of legal moves, which depends on the variant.
+func (gs *GameState) IsDeadPosition() bool {
+	return gs.rules().DeadPosition(gs)
+}
+
+// ClaimableDraw returns the reason a player to move could claim a draw, or
+// NoDraw when no claim is available.
+func (gs *GameState) ClaimableDraw() DrawReason {
+	switch {
+	case gs.IsThreefoldRepetition():
+		return ThreefoldRepetition
+	case gs.IsFiftyMoveRule():
+		return FiftyMoveRule
+	}
+	return NoDraw
+}
+
+// AutomaticDraw returns the reason the game is drawn without a claim, or
+// NoDraw when play continues.
+func (gs *GameState) AutomaticDraw() DrawReason {
+	switch {
+	case gs.rules().StalemateDraws() && gs.IsStalemate():
+		return StalematePosition
+	case gs.IsDeadPosition():
+		return InsufficientMaterial
+	case gs.IsFivefoldRepetition():
+		return FivefoldRepetition
+	case gs.IsSeventyFiveMoveRule() && !gs.IsCheckmate():
+		return SeventyFiveMoveRule
+	}
+	return NoDraw
+}
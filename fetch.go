@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// maxExportIDs is the most games lichess exports by ID in one request
+const maxExportIDs = 300
+
+// fetchSources are the collections of games that can be fetched
+var fetchSources = []string{"ids", "tournament", "swiss", "study", "broadcast"}
+
+// handlerFetch downloads a collection of games, such as the games of a club
+// event, into its own folder of the game directory and analyzes them.
+func (s *state) handlerFetch(args []string) error {
+	flags := flag.NewFlagSet("fetch", flag.ContinueOnError)
+	dirName := flags.String("dir", "", "folder of the game directory to save to, named after the source by default")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: lichan fetch [flags] %s id...\n", strings.Join(fetchSources, "|"))
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() < 2 {
+		flags.Usage()
+		return errors.New("Nothing to fetch")
+	}
+
+	source, ids := flags.Arg(0), flags.Args()[1:]
+	if !slices.Contains(fetchSources, source) {
+		return fmt.Errorf("Unknown source %q, expected one of %s", source, strings.Join(fetchSources, ", "))
+	}
+
+	// Games fetched by ID share one folder, and every event gets its own
+	// unless a folder is given.
+	type folder struct {
+		dir string
+		ids []string
+	}
+	var folders []folder
+	switch {
+	case *dirName != "":
+		folders = append(folders, folder{*dirName, ids})
+	case source == "ids":
+		folders = append(folders, folder{"games", ids})
+	default:
+		for _, ref := range ids {
+			id, err := sourceID(source, ref)
+			if err != nil {
+				return err
+			}
+			folders = append(folders, folder{fmt.Sprintf("%s_%s", source, id), []string{ref}})
+		}
+	}
+	for _, f := range folders {
+		err = s.fetch(source, f.ids, f.dir)
+		if err != nil {
+			return err
+		}
+		err = s.handlerAnalyze(f.dir)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceID reads the ID of a game or event from a bare ID or a lichess URL.
+// Each source puts its ID in a different place of the URL:
+//   - a game is the first segment, /{gameId}/black, whose first eight
+//     characters are the game; a player's URL appends four more
+//   - a tournament, swiss or study follows its name, /study/{studyId}/{chapterId}
+//   - a broadcast round follows the slugs of the broadcast and round,
+//     /broadcast/{tourSlug}/{roundSlug}/{roundId}, or round in the API
+func sourceID(source, ref string) (id string, err error) {
+	ref = strings.TrimSpace(ref)
+	u, err := url.Parse(ref)
+	if err != nil {
+		return
+	}
+	var segments []string
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	if u.Host == "" && len(segments) > 1 && strings.Contains(segments[0], ".") {
+		// lichess.org/... without a scheme
+		segments = segments[1:]
+	}
+	if len(segments) > 0 {
+		segments[len(segments)-1] = strings.TrimSuffix(segments[len(segments)-1], ".pgn")
+	}
+
+	after := func(name string, offset int) string {
+		if i := slices.Index(segments, name); i >= 0 && i+offset < len(segments) {
+			return segments[i+offset]
+		}
+		if len(segments) == 1 {
+			return segments[0]
+		}
+		return ""
+	}
+	switch source {
+	case "ids":
+		if len(segments) > 0 {
+			id = segments[0]
+			if len(id) > 8 {
+				id = id[:8]
+			}
+		}
+	case "tournament", "swiss", "study":
+		id = after(source, 1)
+	case "broadcast":
+		if id = after("round", 1); id == "" {
+			id = after("broadcast", 3)
+		}
+	}
+	if id == "" {
+		err = fmt.Errorf("No %s ID in %q", source, ref)
+	}
+	return
+}
+
+// fetch saves the games of the source to a folder of the game directory
+func (s *state) fetch(source string, ids []string, dir string) error {
+	outputDir := filepath.Join(s.Config.GameDirectory, dir)
+	err := os.MkdirAll(outputDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	switch source {
+	case "ids":
+		var gameIDs []string
+		for _, list := range ids {
+			for _, ref := range splitList(list) {
+				id, err := sourceID(source, ref)
+				if err != nil {
+					return err
+				}
+				if !slices.Contains(gameIDs, id) {
+					gameIDs = append(gameIDs, id)
+				}
+			}
+		}
+		for start := 0; start < len(gameIDs); start += maxExportIDs {
+			batch := gameIDs[start:min(start+maxExportIDs, len(gameIDs))]
+			err = s.fetchGames(http.MethodPost, "/api/games/export/_ids", strings.Join(batch, ","), outputDir)
+			if err != nil {
+				return err
+			}
+		}
+	case "tournament", "swiss":
+		for _, ref := range ids {
+			id, err := sourceID(source, ref)
+			if err != nil {
+				return err
+			}
+			err = s.fetchGames(http.MethodGet, fmt.Sprintf("/api/%s/%s/games", source, url.PathEscape(id)), "", outputDir)
+			if err != nil {
+				return err
+			}
+		}
+	case "study":
+		for _, ref := range ids {
+			id, err := sourceID(source, ref)
+			if err != nil {
+				return err
+			}
+			err = s.fetchPGN(fmt.Sprintf("/api/study/%s.pgn", url.PathEscape(id)), outputDir, "study_"+id+".pgn")
+			if err != nil {
+				return err
+			}
+		}
+	case "broadcast":
+		for _, ref := range ids {
+			id, err := sourceID(source, ref)
+			if err != nil {
+				return err
+			}
+			err = s.fetchPGN(fmt.Sprintf("/api/broadcast/round/%s.pgn", url.PathEscape(id)), outputDir, "broadcast_"+id+".pgn")
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("Unknown source %q, expected one of %s", source, strings.Join(fetchSources, ", "))
+	}
+	return nil
+}
+
+// fetchGames saves the games of an NDJSON export to outputDir
+func (s *state) fetchGames(method, path, body, outputDir string) error {
+	opts := url.Values{}
+	for _, opt := range []string{"opening", "clocks", "evals", "accuracy"} {
+		opts.Set(opt, "true")
+	}
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := s.Lichess.NewRequest(context.Background(), method, path, opts, reqBody)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+	if body != "" {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	res, err := s.Lichess.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	downloaded, err := s.saveGames(res.Body, outputDir, nil)
+	log.Printf("Downloaded %d games to %s\n", downloaded, outputDir)
+	return err
+}
+
+// fetchPGN saves a PGN export, such as the chapters of a study, as a single
+// file. An analysis of an older copy of the file is removed, so an event
+// fetched again while it is still going on is analyzed again.
+func (s *state) fetchPGN(path, outputDir, fileName string) error {
+	opts := url.Values{}
+	opts.Set("clocks", "true")
+	opts.Set("comments", "true")
+	req, err := s.Lichess.NewRequest(context.Background(), http.MethodGet, path, opts, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/x-chess-pgn")
+	res, err := s.Lichess.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	pgn, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	gamePath := filepath.Join(outputDir, fileName)
+	if old, err := os.ReadFile(gamePath); err == nil && bytes.Equal(old, pgn) {
+		log.Printf("%s is unchanged\n", gamePath)
+		return nil
+	}
+	err = writeFileAtomic(gamePath, pgn)
+	if err != nil {
+		return err
+	}
+	enginePath := filepath.Join(s.Config.EngineDirectory, filepath.Base(outputDir), engineFileName(fileName))
+	err = os.Remove(enginePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Printf("Wrote %s\n", gamePath)
+	return nil
+}
@@ -66,6 +66,23 @@ type piece struct {
 type GameState struct {
 	PlayerTurn PlayerColor
 	Pieces     map[string]piece
+	// CastlingRooks holds the squares of the rooks that can still castle
+	CastlingRooks []string
+	// Chess960 games write castling as the king capturing its own rook
+	Chess960       bool
+	EnPassant      string
+	HalfmoveClock  int
+	FullmoveNumber int
+	// History holds the hashes of every earlier position in the game
+	History []uint64
+	// Variant is nil for standard chess
+	Variant Variant
+	// Checks counts the checks given by each player in three-check
+	Checks [2]int
+	// Pockets hold the pieces each player can drop in crazyhouse, and
+	// Promoted the squares of promoted pieces which return as pawns.
+	Pockets  [2][]PieceType
+	Promoted []string
 }
 
 type Move struct {
@@ -73,7 +90,7 @@ type Move struct {
 	Target, Discriminator string
 	IsCheck, IsCheckmate,
 	IsCapture, IsLongCastle,
-	IsShortCastle bool
+	IsShortCastle, IsDrop bool
 }
 
 type GameResult string
@@ -108,17 +125,20 @@ type Game struct {
 				Name string `json:"name"`
 				ID   string `json:"id"`
 			} `json:"user"`
-			Rating      int  `json:"rating"`
-			RatingDiff  int  `json:"ratingDiff"`
-			Provisional bool `json:"provisional"`
+			Rating      int            `json:"rating"`
+			RatingDiff  int            `json:"ratingDiff"`
+			Provisional bool           `json:"provisional"`
+			Analysis    PlayerAnalysis `json:"analysis"`
 		} `json:"white"`
 		Black struct {
 			User struct {
 				Name string `json:"name"`
 				ID   string `json:"id"`
 			} `json:"user"`
-			Rating     int `json:"rating"`
-			RatingDiff int `json:"ratingDiff"`
+			Rating      int            `json:"rating"`
+			RatingDiff  int            `json:"ratingDiff"`
+			Provisional bool           `json:"provisional"`
+			Analysis    PlayerAnalysis `json:"analysis"`
 		} `json:"black"`
 	} `json:"players"`
 	InitalFEN string `json:"initialFen"`
@@ -130,11 +150,18 @@ type Game struct {
 		Ply  int    `json:"ply"`
 	} `json:"opening"`
 	Moves string `json:"moves"`
-	Clock struct {
+	// Clocks holds the time left after each ply in centiseconds
+	Clocks   []int          `json:"clocks"`
+	Analysis []MoveAnalysis `json:"analysis"`
+	Clock    struct {
 		Initial   int `json:"initial"`
 		Increment int `json:"increment"`
 		TotalTime int `json:"totalTime"`
 	} `json:"clock"`
+	// Tags holds the tags of a game read from PGN, in their original order
+	Tags []PGNTag `json:"-"`
+	// Tree holds the moves with their comments and variations
+	Tree *PGNNode `json:"-"`
 }
 
 func (g *Game) WriteGame(s *state, outputDir string) error {
@@ -143,11 +170,7 @@ func (g *Game) WriteGame(s *state, outputDir string) error {
 		return err
 	}
 
-	gameYear, gameMonth, gameDay := time.UnixMilli(g.CreatedAt).Date()
-	gameDate := fmt.Sprintf("%d.%d.%d", gameYear, gameMonth, gameDay)
-
-	fileTitle := fmt.Sprintf("%s_%s.pgn", gameDate, g.ID)
-	gameFilePath := fmt.Sprintf("%s/%s", outputDir, fileTitle)
+	gameFilePath := fmt.Sprintf("%s/%s", outputDir, g.pgnFileName())
 	err = os.WriteFile(gameFilePath, []byte(gameString), 0644)
 	if err != nil {
 		return err
@@ -156,38 +179,71 @@ func (g *Game) WriteGame(s *state, outputDir string) error {
 	return nil
 }
 
-func GameFromPGN(data []byte) (*Game, error) {
-	if bytes.ContainsAny(data, "\t") {
-		return &Game{}, errors.New("PGN format must not contain any tabs")
-	}
-	scanner := bufio.NewScanner(bytes.NewReader(data))
-	scanner.Split(tokenizerPGN)
+func (g *Game) IsChess960() bool {
+	return g.Variant == "chess960"
+}
 
-	valuesMap := make(map[string]string)
-	game := Game{}
-	for scanner.Scan() {
-		// Move strings should not be lower case, but PGN keys should be for matching
-		cleanKey := strings.TrimSpace(scanner.Text())
-		key := strings.ToLower(cleanKey)
-		if key == "[" || key == "]" {
-			continue
+// SetStatusFromState records checkmate, stalemate and automatic draws for
+// games that reached the final position without a status, e.g. games read
+// from a PGN file.
+func (g *Game) SetStatusFromState(gs *GameState) {
+	if g.Status != "" {
+		return
+	}
+	if result := gs.rules().Outcome(gs); result != Unknown {
+		g.Status = "variantEnd"
+		if g.Winner == "" {
+			switch result {
+			case WhiteWins:
+				g.Winner = "white"
+			case BlackWins:
+				g.Winner = "black"
+			default:
+				g.Winner = "draw"
+			}
 		}
-		if scanner.Scan() {
-			val := strings.TrimSpace(scanner.Text())
-			if val == "]" {
-				fmt.Printf("missing value for key: %s\n", key)
-				break
+		return
+	}
+	switch {
+	case gs.IsCheckmate():
+		g.Status = "mate"
+		if g.Winner == "" {
+			if gs.PlayerTurn == White {
+				g.Winner = "black"
+			} else {
+				g.Winner = "white"
 			}
-			valuesMap[key] = val
-		} else {
-			// If none of the keys match, then it is assumed this is the move string.
-			// This assumption seems likely to be wrong in edge cases. As of now, I don't
-			// have an assertive way of identifying a move string.
-			// Assuming move strings has caused this many bugs: 1
-			valuesMap["moves"] = cleanKey
+		}
+	case gs.rules().StalemateDraws() && gs.IsStalemate():
+		g.Status = "stalemate"
+		if g.Winner == "" {
+			g.Winner = "draw"
+		}
+	case gs.AutomaticDraw() != NoDraw:
+		g.Status = "draw"
+		if g.Winner == "" {
+			g.Winner = "draw"
 		}
 	}
+}
 
+func GameFromPGN(data []byte) (*Game, error) {
+	pgnGame, err := NewPGNReader(bytes.NewReader(data)).Read()
+	if err != nil {
+		return &Game{}, err
+	}
+	return pgnGame.ToGame(), nil
+}
+
+// ToGame fills a Game from the tags and main line of a parsed PGN game
+func (pg *PGNGame) ToGame() *Game {
+	valuesMap := make(map[string]string)
+	for _, tag := range pg.Tags {
+		// PGN keys are matched case insensitively
+		valuesMap[strings.ToLower(tag.Name)] = tag.Value
+	}
+
+	game := Game{Tags: slices.Clone(pg.Tags)}
 	for key, val := range valuesMap {
 		switch key {
 		case "event":
@@ -233,11 +289,16 @@ func GameFromPGN(data []byte) (*Game, error) {
 				game.Winner = "draw"
 			default:
 			}
+		case "eco":
+			game.Opening.Eco = strings.TrimSpace(val)
 		case "gameid":
 			game.ID = strings.TrimSpace(val)
 		case "opening":
 			game.Opening.Name = strings.TrimSpace(val)
 		case "whiteelo":
+			if val == "?" || val == "" {
+				break
+			}
 			elo, err := strconv.Atoi(val)
 			if err != nil {
 				log.Printf("Could not parse rating as int: %v\n", err)
@@ -245,6 +306,9 @@ func GameFromPGN(data []byte) (*Game, error) {
 			}
 			game.Players.White.Rating = elo
 		case "blackelo":
+			if val == "?" || val == "" {
+				break
+			}
 			elo, err := strconv.Atoi(val)
 			if err != nil {
 				log.Printf("Could not parse rating as int: %v\n", err)
@@ -269,27 +333,43 @@ func GameFromPGN(data []byte) (*Game, error) {
 			}
 		case "fen":
 			game.InitalFEN = strings.TrimSpace(val)
-		case "moves":
-			moveNumberRE, err := regexp.Compile(`^\d+\.$`)
-			if err != nil {
-				log.Printf("Bad regexp: %v\n", err)
-				break
-			}
-			var gameMoves string
-			for token := range strings.SplitSeq(val, " ") {
-				if moveNumberRE.MatchString(token) {
-					continue
-				}
-				if _, ok := IsValidGameResult[GameResult(token)]; ok {
-					continue
-				}
-				gameMoves = fmt.Sprintf("%s %s", gameMoves, token)
+		case "variant":
+			if v, ok := LookupVariantPGNName(val); ok {
+				game.Variant = v.Key()
+			} else {
+				game.Variant = strings.TrimSpace(val)
 			}
-			game.Moves = strings.TrimSpace(gameMoves)
 		default:
 		}
 	}
-	return &game, nil
+	// UTCDate and UTCTime give the start of the game more precisely than Date
+	if utcDate, ok := valuesMap["utcdate"]; ok {
+		created, err := time.Parse("2006.01.02 15:04:05", utcDate+" "+valuesMap["utctime"])
+		if err != nil {
+			created, err = time.Parse("2006.01.02", utcDate)
+		}
+		if err == nil {
+			game.CreatedAt = created.UnixMilli()
+		}
+	}
+	// Events such as tournaments don't name the speed, but the clock gives it
+	if game.Speed == "" && strings.Contains(valuesMap["timecontrol"], "+") {
+		game.Speed = clockSpeed(game.Clock.Initial, game.Clock.Increment)
+	}
+	if game.Winner == "" {
+		switch pg.Result {
+		case BlackWins:
+			game.Winner = "black"
+		case WhiteWins:
+			game.Winner = "white"
+		case Draw:
+			game.Winner = "draw"
+		}
+	}
+	game.Tree = pg.Root
+	game.Moves = strings.Join(pg.Root.Mainline(), " ")
+	game.readMoveTree()
+	return &game
 }
 
 func tokenizerMoveString(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -354,117 +434,188 @@ func tokenizerMoveString(data []byte, atEOF bool) (advance int, token []byte, er
 	return
 }
 
-func tokenizerPGN(data []byte, atEOF bool) (advance int, token []byte, err error) {
-	if atEOF && len(data) == 0 {
-		return
-	}
-	for i := 0; i < len(data); i++ {
-		advance++
-		nextByte := string(data[i])
-		if nextByte == "[" || nextByte == "]" {
-			token = append(token, data[i])
-			break
-		}
+func GameToPGN(game *Game, url string) (string, error) {
+	var sb strings.Builder
+	writePGNTags(&sb, game.PGNTags(url))
+	fmt.Fprintf(&sb, "\n%s\n", wrapMovetext(movetext(game.MoveTree(), startingPly(game.InitalFEN), game.Result())))
+	return sb.String(), nil
+}
 
-		if nextByte == "\"" {
-			break
+// MoveTree returns the game's move tree, building it from the moves,
+// clocks and server analysis of a downloaded game.
+func (g *Game) MoveTree() *PGNNode {
+	if g.Tree != nil {
+		return g.Tree
+	}
+	g.Tree = &PGNNode{}
+	node := g.Tree
+	for ply, move := range strings.Fields(g.Moves) {
+		node = node.AddVariation([]string{move})
+		if ply < len(g.Clocks) {
+			clock := g.Clocks[ply]
+			node.Clock = &clock
 		}
-
-		if nextByte == "\n" {
-			continue
+		if ply < len(g.Analysis) && g.Analysis[ply].PGNEval() != "" {
+			node.Eval = &MoveAnalysis{Eval: g.Analysis[ply].Eval, Mate: g.Analysis[ply].Mate}
 		}
-
-		token = append(token, data[i])
-	}
-	if len(token) > 0 && string(token[0]) == "\"" {
-		err = errors.New("Malformed PGN: Unmatch quotation mark")
 	}
-	return
+	return g.Tree
 }
 
-func GameToPGN(game *Game, url string) (string, error) {
-	pgnTemplate := `[Event "%s"]
-[Site "%s/%s"]
-[Date "%s"]
-[Round "-"]
-[White "%s"]
-[Black "%s"]
-[Result "%s"]
-[GameId "%s"]
-[WhiteElo "%d"]
-[BlackElo "%d"]
-[Opening "%s"]
-[TimeControl "%s"]%s
-
-%s
-`
-	var event string
-	if game.Rated {
-		event = fmt.Sprintf("%s %s game", "rated", game.Speed)
-	} else {
-		event = fmt.Sprintf("%s %s game", "unrated", game.Speed)
-	}
-
-	gameYear, gameMonth, gameDay := time.UnixMilli(game.CreatedAt).Date()
-	gameDate := fmt.Sprintf("%d.%d.%d", gameYear, gameMonth, gameDay)
+// sevenTagRoster lists the tags every PGN game carries, in export order
+var sevenTagRoster = []PGNTag{
+	{Name: "Event", Value: "?"},
+	{Name: "Site", Value: "?"},
+	{Name: "Date", Value: "????.??.??"},
+	{Name: "Round", Value: "?"},
+	{Name: "White", Value: "?"},
+	{Name: "Black", Value: "?"},
+	{Name: "Result", Value: string(Unknown)},
+}
 
-	var result GameResult
-	switch game.Winner {
+func (g *Game) Result() GameResult {
+	switch g.Winner {
 	case "black":
-		result = BlackWins
+		return BlackWins
 	case "white":
-		result = WhiteWins
+		return WhiteWins
 	case "draw":
-		result = Draw
+		return Draw
 	default:
-		result = Unknown
+		return Unknown
 	}
+}
 
-	gameTimeControl := fmt.Sprintf("%d +%d", game.Clock.Initial, game.Clock.Increment)
+// PGNTags returns the tags to write for the game: the tags it was read
+// with, or ones built from the lichess fields for downloaded games. The
+// Seven Tag Roster always comes first and the Result follows the game.
+func (g *Game) PGNTags(url string) (tags []PGNTag) {
+	source := g.Tags
+	if len(source) == 0 {
+		source = g.lichessTags(url)
+	}
 
-	moveSlice := strings.Split(game.Moves, " ")
-	whiteMove := true
-	var moveString string
-	moveCounter := 1
-	for _, move := range moveSlice {
-		if !whiteMove {
-			moveString = fmt.Sprintf("%s %s", moveString, move)
-			moveCounter++
-		} else {
-			if moveCounter != 1 {
-				moveString = fmt.Sprintf("%s %d. %s", moveString, moveCounter, move)
-			} else {
-				moveString = fmt.Sprintf("%d. %s", moveCounter, move)
-			}
+	for _, rosterTag := range sevenTagRoster {
+		tag := rosterTag
+		if i := slices.IndexFunc(source, func(t PGNTag) bool { return t.Name == rosterTag.Name }); i >= 0 {
+			tag = source[i]
+		}
+		if tag.Name == "Result" {
+			tag.Value = string(g.Result())
 		}
-		whiteMove = !whiteMove
+		tags = append(tags, tag)
 	}
-	moveString = fmt.Sprintf("%s %s", moveString, result)
+	for _, tag := range source {
+		if !slices.ContainsFunc(sevenTagRoster, func(t PGNTag) bool { return t.Name == tag.Name }) {
+			tags = append(tags, tag)
+		}
+	}
+	return
+}
 
-	var fen string
-	if game.InitalFEN == "" {
-		fen = fmt.Sprintf("\n[FEN \"%s\"]", standardStartingFEN)
+func (g *Game) lichessTags(url string) (tags []PGNTag) {
+	var event string
+	if g.Rated {
+		event = fmt.Sprintf("%s %s game", "rated", g.Speed)
 	} else {
-		fen = fmt.Sprintf("\n[FEN \"%s\"]", game.InitalFEN)
-	}
-
-	gamePGN := fmt.Sprintf(pgnTemplate,
-		event,
-		url,
-		game.ID,
-		gameDate,
-		game.Players.White.User.Name,
-		game.Players.Black.User.Name,
-		result,
-		game.ID,
-		game.Players.White.Rating,
-		game.Players.Black.Rating,
-		game.Opening.Name,
-		gameTimeControl,
-		fen,
-		moveString,
+		event = fmt.Sprintf("%s %s game", "unrated", g.Speed)
+	}
+
+	// Dates in PGN are always UTC
+	created := time.UnixMilli(g.CreatedAt).UTC()
+
+	tags = []PGNTag{
+		{Name: "Event", Value: event},
+		{Name: "Site", Value: fmt.Sprintf("%s/%s", url, g.ID)},
+		{Name: "Date", Value: created.Format("2006.01.02")},
+		{Name: "Round", Value: "-"},
+		{Name: "White", Value: g.Players.White.User.Name},
+		{Name: "Black", Value: g.Players.Black.User.Name},
+		{Name: "Result", Value: string(g.Result())},
+		{Name: "GameId", Value: g.ID},
+		{Name: "UTCDate", Value: created.Format("2006.01.02")},
+		{Name: "UTCTime", Value: created.Format("15:04:05")},
+		{Name: "WhiteElo", Value: pgnRating(g.Players.White.Rating)},
+		{Name: "BlackElo", Value: pgnRating(g.Players.Black.Rating)},
+	}
+	if g.Opening.Eco != "" {
+		tags = append(tags, PGNTag{Name: "ECO", Value: g.Opening.Eco})
+	}
+	if g.Opening.Name != "" {
+		tags = append(tags, PGNTag{Name: "Opening", Value: g.Opening.Name})
+	}
+	tags = append(tags,
+		PGNTag{Name: "TimeControl", Value: g.timeControl()},
+		PGNTag{Name: "Termination", Value: g.termination()},
 	)
-	return gamePGN, nil
+
+	// A set up position is only recorded when the game did not start from
+	// the usual position of its variant
+	v, ok := LookupVariant(g.Variant)
+	if ok && v.Key() != "standard" {
+		tags = append(tags, PGNTag{Name: "Variant", Value: v.PGNName()})
+	}
+	if g.InitalFEN != "" && (!ok || g.InitalFEN != v.StartingFEN() || g.IsChess960()) {
+		tags = append(tags, PGNTag{Name: "SetUp", Value: "1"}, PGNTag{Name: "FEN", Value: g.InitalFEN})
+	}
+	return
+}
+
+// clockSpeed names the speed of a clock the way lichess does, from the time
+// a game of 40 moves is expected to take.
+func clockSpeed(initial, increment int) string {
+	switch estimate := initial + 40*increment; {
+	case estimate < 30:
+		return "ultraBullet"
+	case estimate < 180:
+		return "bullet"
+	case estimate < 480:
+		return "blitz"
+	case estimate < 1500:
+		return "rapid"
+	default:
+		return "classical"
+	}
+}
+
+// timeControl writes the clock as initial seconds plus increment, or "-"
+// for games without a clock.
+func (g *Game) timeControl() string {
+	if g.Clock.Initial == 0 && g.Clock.Increment == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d+%d", g.Clock.Initial, g.Clock.Increment)
+}
+
+// pgnRating writes a rating, or "?" for anonymous players and the AI, who
+// have none
+func pgnRating(rating int) string {
+	if rating == 0 {
+		return "?"
+	}
+	return strconv.Itoa(rating)
+}
+
+// termination maps the lichess game status to the PGN Termination tag
+func (g *Game) termination() string {
+	switch g.Status {
+	case "", "created", "started":
+		return "Unterminated"
+	case "outoftime", "timeout":
+		return "Time forfeit"
+	case "aborted", "noStart":
+		return "Abandoned"
+	case "cheat":
+		return "Rules infraction"
+	default:
+		return "Normal"
+	}
+}
+
+func writePGNTags(sb *strings.Builder, tags []PGNTag) {
+	for _, tag := range tags {
+		fmt.Fprintf(sb, "[%s \"%s\"]\n", tag.Name, escapePGNString(tag.Value))
+	}
 }
 
 func NewGameState(fen string) (gs *GameState, err error) {
@@ -478,7 +629,7 @@ func NewGameState(fen string) (gs *GameState, err error) {
 		return
 	}
 
-	fenFields := strings.Split(fen, " ")
+	fenFields := strings.Fields(fen)
 	if len(fenFields) != 6 {
 		err = errors.New("Invalid FEN string")
 		return
@@ -490,50 +641,103 @@ func NewGameState(fen string) (gs *GameState, err error) {
 		return
 	}
 
-	gs = &GameState{}
+	gs = &GameState{
+		Pieces: make(map[string]piece),
+	}
 
-	if fenFields[1] == "w" {
+	switch fenFields[1] {
+	case "w":
 		gs.PlayerTurn = White
-	} else {
+	case "b":
 		gs.PlayerTurn = Black
+	default:
+		err = fmt.Errorf("Invalid player turn in FEN: %s", fenFields[1])
+		return
 	}
 
 	squareTracker := 0
-	for ch := range fen[0] {
-		if unicode.IsNumber(rune(ch)) {
+	for _, ch := range fenFields[0] {
+		if ch == '/' {
+			continue
+		}
+		if unicode.IsNumber(ch) {
 			num, _ := strconv.Atoi(string(ch))
 			squareTracker = squareTracker + num
 			continue
 		}
+		if squareTracker >= len(fenBoardOrder) {
+			err = errors.New("Too many squares in FEN string")
+			return
+		}
 		newPiece := piece{}
-		if unicode.IsUpper(rune(ch)) {
+		if unicode.IsUpper(ch) {
 			newPiece.PlayerColor = White
 		} else {
 			newPiece.PlayerColor = Black
 		}
-		switch strings.ToLower(string(ch)) {
-		case "p":
+		switch unicode.ToLower(ch) {
+		case 'p':
 			newPiece.PieceType = Pawn
-		case "n":
+		case 'n':
 			newPiece.PieceType = Knight
-		case "b":
+		case 'b':
 			newPiece.PieceType = Bishop
-		case "r":
+		case 'r':
 			newPiece.PieceType = Rook
-		case "q":
+		case 'q':
 			newPiece.PieceType = Queen
-		case "k":
+		case 'k':
 			newPiece.PieceType = King
+		default:
+			err = fmt.Errorf("Invalid piece in FEN: %c", ch)
+			return
 		}
 		newPiece.Square = fenBoardOrder[squareTracker]
 		gs.Pieces[newPiece.Square] = newPiece
 		squareTracker++
 	}
+	if squareTracker != len(fenBoardOrder) {
+		err = errors.New("Wrong number of squares in FEN string")
+		return
+	}
+
+	err = gs.parseCastling(fenFields[2])
+	if err != nil {
+		return
+	}
+	if squareRE.MatchString(fenFields[3]) {
+		gs.EnPassant = fenFields[3]
+	}
+	gs.HalfmoveClock, err = strconv.Atoi(fenFields[4])
+	if err != nil {
+		err = fmt.Errorf("Invalid halfmove clock in FEN: %s", fenFields[4])
+		return
+	}
+	gs.FullmoveNumber, err = strconv.Atoi(fenFields[5])
+	if err != nil {
+		err = fmt.Errorf("Invalid fullmove number in FEN: %s", fenFields[5])
+		return
+	}
 
 	return
 }
 
+var dropRE = regexp.MustCompile(`^([KQRBNP]?)@([a-h][1-8])([+#]?)$`)
+
 func ParseMoveString(ms string) (move *Move, err error) {
+	if matches := dropRE.FindStringSubmatch(strings.TrimSpace(ms)); matches != nil {
+		move = &Move{
+			PieceType:   PieceType(matches[1]),
+			Target:      matches[2],
+			IsDrop:      true,
+			IsCheck:     matches[3] == check,
+			IsCheckmate: matches[3] == mate,
+		}
+		if move.PieceType == "P" {
+			move.PieceType = Pawn
+		}
+		return
+	}
 	scanner := bufio.NewScanner(strings.NewReader(strings.TrimSpace(ms)))
 	scanner.Split(tokenizerMoveString)
 	var tokens []string
@@ -1,6 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
 )
 
@@ -69,7 +74,7 @@ func TestParseMoveString(t *testing.T) {
 		{
 			Input: "O-O-O",
 			Expected: Move{
-				Target:       "O-O-O",
+				PieceType:    King,
 				IsLongCastle: true,
 			},
 			E: nil,
@@ -113,3 +118,293 @@ func TestParseMoveString(t *testing.T) {
 		}
 	}
 }
+
+func TestClockRoundTrip(t *testing.T) {
+	ndjson := `{"id":"q7ZvsdUF","rated":true,"variant":"standard","speed":"blitz","createdAt":1709647200000,"status":"mate","winner":"white",` +
+		`"opening":{"eco":"C20","name":"King's Pawn Game: Wayward Queen Attack","ply":3},` +
+		`"players":{"white":{"user":{"name":"alice","id":"alice"},"rating":1500,"analysis":{"inaccuracy":0,"mistake":0,"blunder":0,"acpl":12,"accuracy":94}},` +
+		`"black":{"user":{"name":"bob","id":"bob"},"rating":1480,"analysis":{"inaccuracy":1,"mistake":0,"blunder":1,"acpl":150,"accuracy":41}}},` +
+		`"moves":"e4 e5 Qh5 Nc6 Bc4 Nf6 Qxf7#","clocks":[30003,30003,29811,29605,29400,28001,27950],` +
+		`"analysis":[{"eval":18},{"eval":22},{"eval":-10},{"eval":5},{"eval":0},{"mate":1,"best":"g7g6","variation":"g6","judgment":{"name":"Blunder","comment":"Checkmate is now unavoidable."}},{}],` +
+		`"clock":{"initial":300,"increment":3,"totalTime":420}}`
+
+	game := Game{}
+	err := json.Unmarshal([]byte(ndjson), &game)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if game.Players.Black.Analysis.Accuracy != 41 || game.Analysis[5].Judgment.Name != "Blunder" {
+		t.Errorf("Analysis does not match expected: %+v %+v\n", game.Players.Black.Analysis, game.Analysis[5])
+	}
+
+	pgn, err := GameToPGN(&game, "https://lichess.org")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	expected := `[Event "rated blitz game"]
+[Site "https://lichess.org/q7ZvsdUF"]
+[Date "2024.03.05"]
+[Round "-"]
+[White "alice"]
+[Black "bob"]
+[Result "1-0"]
+[GameId "q7ZvsdUF"]
+[UTCDate "2024.03.05"]
+[UTCTime "14:00:00"]
+[WhiteElo "1500"]
+[BlackElo "1480"]
+[ECO "C20"]
+[Opening "King's Pawn Game: Wayward Queen Attack"]
+[TimeControl "300+3"]
+[Termination "Normal"]
+
+1. e4 { [%eval 0.18] [%clk 0:05:00] } 1... e5 { [%eval 0.22] [%clk 0:05:00] }
+2. Qh5 { [%eval -0.10] [%clk 0:04:58] } 2... Nc6 { [%eval 0.05] [%clk 0:04:56] }
+3. Bc4 { [%eval 0.00] [%clk 0:04:54] } 3... Nf6 { [%eval #1] [%clk 0:04:40] }
+4. Qxf7# { [%clk 0:04:39] } 1-0
+`
+	if pgn != expected {
+		t.Errorf("PGN\n%s\ndoes not match expected:\n%s\n", pgn, expected)
+	}
+
+	parsed, err := GameFromPGN([]byte(pgn))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if parsed.Moves != game.Moves || parsed.CreatedAt != game.CreatedAt || parsed.Opening.Eco != "C20" {
+		t.Errorf("Moves %s, start %d and ECO %s do not match expected\n", parsed.Moves, parsed.CreatedAt, parsed.Opening.Eco)
+	}
+	// Clocks are written in whole seconds
+	if !slices.Equal(parsed.Clocks, []int{30000, 30000, 29800, 29600, 29400, 28000, 27900}) {
+		t.Errorf("Clocks %v do not match expected\n", parsed.Clocks)
+	}
+	if len(parsed.Analysis) != 7 || *parsed.Analysis[2].Eval != -10 || *parsed.Analysis[5].Mate != 1 || parsed.Analysis[6].PGNEval() != "" {
+		t.Errorf("Analysis %+v does not match expected\n", parsed.Analysis)
+	}
+}
+
+func TestParseClock(t *testing.T) {
+	tests := []struct {
+		Input    string
+		Expected int
+	}{
+		{Input: "0:05:00", Expected: 30000},
+		{Input: "1:02:03", Expected: 372300},
+		{Input: "0:00:09.8", Expected: 980},
+	}
+	for _, test := range tests {
+		centis, err := parseClock(test.Input)
+		if err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+			continue
+		}
+		if centis != test.Expected {
+			t.Errorf("Clock %s is %d, expected %d\n", test.Input, centis, test.Expected)
+		}
+	}
+	if _, err := parseClock("5:00"); err == nil {
+		t.Errorf("Expected an error for a clock without hours\n")
+	}
+}
+
+func TestTagPreservation(t *testing.T) {
+	input := `[White "Carlsen, Magnus"]
+[Event "Club \"Open\""]
+[Black "Nepomniachtchi, Ian"]
+[ECO "C65"]
+[Annotator "lichan"]
+[Date "2024.03.05"]
+[Result "*"]
+[Site "Utrecht NED"]
+[MyCustomTag "kept"]
+
+1. e4 e5 2. Nf3 Nc6 3. Bb5 Nf6 1/2-1/2
+`
+	expected := `[Event "Club \"Open\""]
+[Site "Utrecht NED"]
+[Date "2024.03.05"]
+[Round "?"]
+[White "Carlsen, Magnus"]
+[Black "Nepomniachtchi, Ian"]
+[Result "1/2-1/2"]
+[ECO "C65"]
+[Annotator "lichan"]
+[MyCustomTag "kept"]
+
+1. e4 e5 2. Nf3 Nc6 3. Bb5 Nf6 1/2-1/2
+`
+	game, err := GameFromPGN([]byte(input))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	pgn, err := GameToPGN(game, "https://lichess.org")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if pgn != expected {
+		t.Errorf("PGN\n%s\ndoes not match expected:\n%s\n", pgn, expected)
+	}
+
+	again, err := GameFromPGN([]byte(pgn))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v\n", err)
+	}
+	if !slices.Equal(again.Tags, game.PGNTags("")) {
+		t.Errorf("Tags %v changed when read back\n", again.Tags)
+	}
+}
+
+func TestExportFormat(t *testing.T) {
+	tests := []struct {
+		Game     Game
+		Contains []string
+		Excludes []string
+	}{
+		{
+			Game: Game{ID: "abc", Variant: "chess960", Status: "aborted",
+				InitalFEN: "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9"},
+			Contains: []string{
+				"[TimeControl \"-\"]\n",
+				"[Termination \"Abandoned\"]\n",
+				"[Variant \"Chess960\"]\n[SetUp \"1\"]\n[FEN \"bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9\"]\n",
+				"\n\n*\n",
+			},
+		},
+		{
+			Game:     Game{ID: "def", Variant: "crazyhouse", Status: "outoftime", Winner: "black", Moves: "e4", CreatedAt: 1709600000000},
+			Contains: []string{"[Date \"2024.03.05\"]", "[UTCTime \"00:53:20\"]", "[Variant \"Crazyhouse\"]", "[Termination \"Time forfeit\"]", "\n\n1. e4 0-1\n"},
+			Excludes: []string{"[FEN ", "[SetUp "},
+		},
+		{
+			// lichess ends games of a player who left as a loss on time
+			Game: func() (g Game) {
+				g = Game{ID: "jkl", Status: "timeout", Winner: "white", Moves: "e4"}
+				g.Players.White.Rating = 1500
+				return
+			}(),
+			Contains: []string{"[Termination \"Time forfeit\"]", "[WhiteElo \"1500\"]", "[BlackElo \"?\"]"},
+		},
+		{
+			Game:     Game{ID: "ghi", Status: "mate", InitalFEN: standardStartingFEN},
+			Excludes: []string{"[FEN ", "[SetUp ", "[Variant "},
+		},
+	}
+	for _, test := range tests {
+		pgn, err := GameToPGN(&test.Game, "https://lichess.org")
+		if err != nil {
+			t.Errorf("Unexpected error: %v\n", err)
+			continue
+		}
+		for _, c := range test.Contains {
+			if !strings.Contains(pgn, c) {
+				t.Errorf("PGN of %s\n%s\ndoes not contain %q\n", test.Game.ID, pgn, c)
+			}
+		}
+		for _, e := range test.Excludes {
+			if strings.Contains(pgn, e) {
+				t.Errorf("PGN of %s\n%s\nshould not contain %q\n", test.Game.ID, pgn, e)
+			}
+		}
+	}
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	path := archivePath(t.TempDir())
+	lines := []string{
+		`{"id":"abcdefgh","rated":true,"createdAt":1709647200000,"status":"mate","players":{"white":{"user":{"name":"alice"},"rating":1500,"ratingDiff":7},"black":{"user":{"name":"bob"},"rating":1480,"ratingDiff":-7,"provisional":true}},"winner":"white","moves":"e4 e5 Qh5 Nc6 Bc4 Nf6 Qxf7#","clocks":[30003,30003,29803,29703,29503,29303,29103]}`,
+		`not a game`,
+		`{"id":"ijklmnop","createdAt":1709650800000,"moves":"d4 d5"}`,
+	}
+	for _, line := range lines {
+		if err := appendToArchive(path, []byte(line)); err != nil {
+			t.Fatalf("Unable to append to archive: %v\n", err)
+		}
+	}
+
+	games, err := readArchive(path)
+	if err != nil {
+		t.Fatalf("Unable to read archive: %v\n", err)
+	}
+	if len(games) != 2 {
+		t.Fatalf("Read %d games, expected 2\n", len(games))
+	}
+	game := games[0]
+	if game.ID != "abcdefgh" || game.Status != "mate" || game.Players.White.RatingDiff != 7 || !game.Players.Black.Provisional || len(game.Clocks) != 7 {
+		t.Errorf("Archived game lost metadata: %+v\n", game)
+	}
+	if name := games[1].pgnFileName(); !strings.HasSuffix(name, "_ijklmnop.pgn") {
+		t.Errorf("PGN file name %s does not match expected\n", name)
+	}
+
+	// A line read into a larger buffer leaves the rest of it alone
+	buffer := []byte(`{"id":"qrstuvwx"}` + "XYZ")
+	appendToArchive(path, buffer[:17])
+	if string(buffer) != `{"id":"qrstuvwx"}XYZ` {
+		t.Errorf("Appending wrote into the buffer: %q\n", buffer)
+	}
+
+	missing, err := readArchive(path + ".missing")
+	if err != nil || len(missing) != 0 {
+		t.Errorf("Missing archive read as %v, %v\n", missing, err)
+	}
+}
+
+func TestCompareAnalysis(t *testing.T) {
+	cp := func(v int) MoveAnalysis { return MoveAnalysis{Eval: &v} }
+	mate := func(v int) MoveAnalysis { return MoveAnalysis{Mate: &v} }
+	game := Game{
+		ID:       "abcdefgh",
+		Moves:    "e4 e5 Qh5 Nc6 Bc4 Nf6 Qxf7#",
+		Analysis: []MoveAnalysis{cp(30), cp(25), cp(-20), cp(10), cp(0), mate(1), {}},
+	}
+	game.Players.White.User.Name = "alice"
+	game.Players.Black.User.Name = "bob"
+
+	// The local engine agrees on the level positions and a won one, but not
+	// on the blunder
+	local := []MoveAnalysis{cp(20), cp(40), cp(-60), cp(-10), cp(30), cp(-150), mate(-1)}
+	for i, node := range game.MoveTree().MainlineNodes() {
+		eval := local[i]
+		node.Eval = &eval
+	}
+
+	diffs := compareAnalysis(&game)
+	var found []string
+	for _, diff := range diffs {
+		found = append(found, diff.String())
+	}
+	expected := []string{"3... Nf6: lichess #1, local -1.50"}
+	if !slices.Equal(found, expected) {
+		t.Errorf("Disagreements %v do not match expected %v\n", found, expected)
+	}
+
+	dir := t.TempDir()
+	if err := reportComparison(dir, &game, diffs); err != nil {
+		t.Fatalf("Unable to write report: %v\n", err)
+	}
+	report, _ := os.ReadFile(filepath.Join(dir, comparisonFileName))
+	if string(report) != "alice - bob (abcdefgh)\n  3... Nf6: lichess #1, local -1.50\n\n" {
+		t.Errorf("Report %q does not match expected\n", report)
+	}
+
+	// Analyzing the game again replaces its entry and keeps the others
+	other := Game{ID: "ijklmnop"}
+	other.Players.White.User.Name = "bob"
+	other.Players.Black.User.Name = "alice"
+	reportComparison(dir, &other, diffs)
+	reportComparison(dir, &game, diffs)
+	reportComparison(dir, &game, diffs)
+	report, _ = os.ReadFile(filepath.Join(dir, comparisonFileName))
+	expectedReport := "bob - alice (ijklmnop)\n  3... Nf6: lichess #1, local -1.50\n\nalice - bob (abcdefgh)\n  3... Nf6: lichess #1, local -1.50\n\n"
+	if string(report) != expectedReport {
+		t.Errorf("Report %q does not match expected %q\n", report, expectedReport)
+	}
+	reportComparison(dir, &other, nil)
+	report, _ = os.ReadFile(filepath.Join(dir, comparisonFileName))
+	if string(report) != "alice - bob (abcdefgh)\n  3... Nf6: lichess #1, local -1.50\n\n" {
+		t.Errorf("Report %q still lists a game now in agreement\n", report)
+	}
+	if !game.hasServerAnalysis() || (&Game{Analysis: []MoveAnalysis{{}}}).hasServerAnalysis() {
+		t.Errorf("Server analysis was not detected\n")
+	}
+}
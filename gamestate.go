@@ -1,5 +1,13 @@
 package main
 
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
 var fenBoardOrder = [64]string{
 	"a8", "b8", "c8", "d8", "e8", "f8", "g8", "h8",
 	"a7", "b7", "c7", "d7", "e7", "f7", "g7", "h7",
@@ -13,7 +21,9 @@ var fenBoardOrder = [64]string{
 
 func initalGameState() *GameState {
 	gs := &GameState{
-		PlayerTurn: White,
+		PlayerTurn:     White,
+		CastlingRooks:  []string{"h1", "a1", "h8", "a8"},
+		FullmoveNumber: 1,
 		Pieces: map[string]piece{
 			"a1": {
 				PieceType:   Rook,
@@ -179,3 +189,178 @@ func initalGameState() *GameState {
 	}
 	return gs
 }
+
+// parseCastling reads the castling field of a FEN. Both X-FEN ("KQkq", with
+// file letters only where the outermost rook is not the castling rook) and
+// Shredder-FEN ("HAha") are accepted. Positions that cannot arise in standard
+// chess switch the state to Chess960.
+func (gs *GameState) parseCastling(field string) error {
+	if field == "-" {
+		return nil
+	}
+	for _, ch := range field {
+		color := White
+		if unicode.IsLower(ch) {
+			color = Black
+		}
+		rank := backRank(color)
+		kingSquare := gs.kingSquare(color)
+		if kingSquare == "" || kingSquare[1] != rank {
+			return fmt.Errorf("Castling rights without a king on the back rank: %s", field)
+		}
+
+		var rookSquare string
+		switch lower := unicode.ToLower(ch); lower {
+		case 'k':
+			for f := byte('h'); f > kingSquare[0]; f-- {
+				if gs.isCastlingRook(string(f)+string(rank), color) {
+					rookSquare = string(f) + string(rank)
+					break
+				}
+			}
+		case 'q':
+			for f := byte('a'); f < kingSquare[0]; f++ {
+				if gs.isCastlingRook(string(f)+string(rank), color) {
+					rookSquare = string(f) + string(rank)
+					break
+				}
+			}
+		case 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h':
+			if gs.isCastlingRook(string(lower)+string(rank), color) {
+				rookSquare = string(lower) + string(rank)
+			}
+			gs.Chess960 = true
+		default:
+			return fmt.Errorf("Invalid castling field in FEN: %s", field)
+		}
+		if rookSquare == "" {
+			return fmt.Errorf("No rook found for castling right %c", ch)
+		}
+		if kingSquare[0] != 'e' || (rookSquare[0] != 'a' && rookSquare[0] != 'h') {
+			gs.Chess960 = true
+		}
+		if !slices.Contains(gs.CastlingRooks, rookSquare) {
+			gs.CastlingRooks = append(gs.CastlingRooks, rookSquare)
+		}
+	}
+	return nil
+}
+
+func (gs *GameState) isCastlingRook(square string, color PlayerColor) bool {
+	p, ok := gs.Pieces[square]
+	return ok && p.PieceType == Rook && p.PlayerColor == color
+}
+
+// castlingFEN writes the castling rights in X-FEN, which is identical to the
+// standard notation for standard chess.
+func (gs *GameState) castlingFEN() string {
+	var field string
+	for _, color := range []PlayerColor{White, Black} {
+		rank := backRank(color)
+		kingSquare := gs.kingSquare(color)
+		var rights []string
+		for _, sq := range gs.CastlingRooks {
+			if sq[1] == rank && kingSquare != "" {
+				rights = append(rights, sq)
+			}
+		}
+		// Kingside rights come first
+		slices.SortFunc(rights, func(a, b string) int { return strings.Compare(b, a) })
+		for _, sq := range rights {
+			letter := string(sq[0])
+			short := sq[0] > kingSquare[0]
+			outermost := true
+			for _, other := range gs.Pieces {
+				if other.PieceType != Rook || other.PlayerColor != color || other.Square[1] != rank {
+					continue
+				}
+				if (short && other.Square[0] > sq[0]) || (!short && other.Square[0] < sq[0]) {
+					outermost = false
+				}
+			}
+			if outermost {
+				letter = "q"
+				if short {
+					letter = "k"
+				}
+			}
+			if color == White {
+				letter = strings.ToUpper(letter)
+			}
+			field += letter
+		}
+	}
+	if field == "" {
+		return "-"
+	}
+	return field
+}
+
+func (gs *GameState) FEN() (fen string) {
+	var board strings.Builder
+	emptySquares := 0
+	for i, sq := range fenBoardOrder {
+		if p, ok := gs.Pieces[sq]; ok {
+			if emptySquares > 0 {
+				fmt.Fprintf(&board, "%d", emptySquares)
+				emptySquares = 0
+			}
+			letter := string(p.PieceType)
+			if p.PieceType == Pawn {
+				letter = "P"
+			}
+			if p.PlayerColor == Black {
+				letter = strings.ToLower(letter)
+			}
+			board.WriteString(letter)
+			if slices.Contains(gs.Promoted, sq) {
+				board.WriteString("~")
+			}
+		} else {
+			emptySquares++
+		}
+		if i%8 == 7 {
+			if emptySquares > 0 {
+				fmt.Fprintf(&board, "%d", emptySquares)
+				emptySquares = 0
+			}
+			if i != len(fenBoardOrder)-1 {
+				board.WriteString("/")
+			}
+		}
+	}
+
+	if _, ok := gs.rules().(crazyhouseRules); ok {
+		board.WriteString("[")
+		for color, pocket := range gs.Pockets {
+			for _, t := range zobristPieceOrder {
+				letter := string(t)
+				if t == Pawn {
+					letter = "P"
+				}
+				if PlayerColor(color) == Black {
+					letter = strings.ToLower(letter)
+				}
+				board.WriteString(strings.Repeat(letter, countPieces(pocket, t)))
+			}
+		}
+		board.WriteString("]")
+	}
+
+	turn := "w"
+	if gs.PlayerTurn == Black {
+		turn = "b"
+	}
+	enPassant := gs.EnPassant
+	if enPassant == "" {
+		enPassant = "-"
+	}
+	fields := []string{board.String(), turn, gs.castlingFEN(), enPassant}
+	if _, ok := gs.rules().(threeCheckRules); ok {
+		// Remaining checks, as lichess writes them
+		fields = append(fields, fmt.Sprintf("%d+%d", 3-gs.Checks[White], 3-gs.Checks[Black]))
+	}
+	fields = append(fields, strconv.Itoa(gs.HalfmoveClock), strconv.Itoa(gs.FullmoveNumber))
+	fen = strings.Join(fields, " ")
+	return
+}
@@ -2,6 +2,4 @@ module github.com/theMagicRabbit/lichan
 
 go 1.25.3
 
-require (
-	github.com/pelletier/go-toml/v2 v2.2.4 // indirect
-)
+require github.com/pelletier/go-toml/v2 v2.2.4
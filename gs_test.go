@@ -1,7 +1,10 @@
 package main
 
 import (
+	"bufio"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -15,6 +18,8 @@ func TestGameState(T *testing.T) {
 		{
 			Input: &GameState{
 				PlayerTurn: Black,
+				HalfmoveClock: 4,
+				FullmoveNumber: 12,
 				Pieces: map[string]piece{
 					"e8": {
 						PieceType: King,
@@ -45,6 +50,8 @@ func TestGameState(T *testing.T) {
 			},
 			Result: &GameState{
 				PlayerTurn: White,
+				HalfmoveClock: 5,
+				FullmoveNumber: 13,
 				Pieces: map[string]piece{
 					"e8": {
 						PieceType: King,
@@ -89,8 +96,362 @@ func TestGameState(T *testing.T) {
 			T.Errorf("Result string %s does not match expected: %s\n", ems, test.ResultString)
 		}
 
+		test.Result.History = []uint64{test.Input.Hash()}
 		if !reflect.DeepEqual(result, test.Result) {
 			T.Errorf("Game state does not match expected:\nResult: %v\nExpect: %v\n", result, test.Result)
 		}
 	}
 }
+
+func perft(gs *GameState, depth int) int {
+	if depth == 0 {
+		return 1
+	}
+	nodes := 0
+	for _, m := range gs.LegalMoves() {
+		next, err := gs.ApplyExtendedMove(m)
+		if err != nil {
+			continue
+		}
+		nodes += perft(next, depth-1)
+	}
+	return nodes
+}
+
+func TestLegalMovesPerft(T *testing.T) {
+	tests := []struct {
+		FEN   string
+		Depth int
+		Nodes int
+	}{
+		{FEN: standardStartingFEN, Depth: 3, Nodes: 8902},
+		{FEN: "r3k2r/p1ppqpb1/bn2pnp1/3PN3/1p2P3/2N2Q1p/PPPBBPPP/R3K2R w KQkq - 0 1", Depth: 2, Nodes: 2039},
+		{FEN: "8/2p5/3p4/KP5r/1R3p1k/8/4P1P1/8 w - - 0 1", Depth: 3, Nodes: 2812},
+		{FEN: "r3k2r/Pppp1ppp/1b3nbN/nP6/BBP1P3/q4N2/Pp1P2PP/R2Q1RK1 w kq - 0 1", Depth: 2, Nodes: 264},
+		{FEN: "rnbq1k1r/pp1Pbppp/2p5/8/2B5/8/PPP1NnPP/RNBQK2R w KQ - 1 8", Depth: 2, Nodes: 1486},
+	}
+
+	for _, test := range tests {
+		gs, err := NewGameState(test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if nodes := perft(gs, test.Depth); nodes != test.Nodes {
+			T.Errorf("Perft(%d) of %s is %d, expected %d\n", test.Depth, test.FEN, nodes, test.Nodes)
+		}
+	}
+}
+
+func TestCheckmateAndStalemate(T *testing.T) {
+	tests := []struct {
+		FEN       string
+		Checkmate bool
+		Stalemate bool
+	}{
+		// Back rank mate
+		{FEN: "3R2k1/5ppp/8/8/8/8/8/6K1 b - - 1 1", Checkmate: true},
+		// The bishop could capture the checking knight but is pinned by the rook
+		{FEN: "R5bk/5Npp/8/8/8/8/8/6K1 b - - 0 1", Checkmate: true},
+		{FEN: "6bk/5Npp/8/8/8/8/8/6K1 b - - 0 1"},
+		// Fool's mate
+		{FEN: "rnb1kbnr/pppp1ppp/8/4p3/6Pq/5P2/PPPPP2P/RNBQKBNR w KQkq - 1 3", Checkmate: true},
+		// The king cannot escape along the line of the checking rook
+		{FEN: "8/8/8/8/8/8/R7/R3k2K b - - 0 1", Checkmate: true},
+		{FEN: "7k/5Q2/6K1/8/8/8/8/8 b - - 0 1", Stalemate: true},
+		{FEN: "k7/P7/1K6/8/8/8/8/8 b - - 0 1", Stalemate: true},
+	}
+
+	for _, test := range tests {
+		gs, err := NewGameState(test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if isMate := gs.IsCheckmate(); isMate != test.Checkmate {
+			T.Errorf("Checkmate for %s is %v, expected %v\n", test.FEN, isMate, test.Checkmate)
+		}
+		if isStalemate := gs.IsStalemate(); isStalemate != test.Stalemate {
+			T.Errorf("Stalemate for %s is %v, expected %v\n", test.FEN, isStalemate, test.Stalemate)
+		}
+	}
+}
+
+func TestRepetition(T *testing.T) {
+	gs := initalGameState()
+	shuffle := []string{"g1f3", "g8f6", "f3g1", "f6g8"}
+	var err error
+	for i := 0; i < 2; i++ {
+		for _, m := range shuffle {
+			if gs.IsThreefoldRepetition() {
+				T.Fatalf("Threefold repetition reported early after %d cycles\n", i)
+			}
+			gs, err = gs.ApplyExtendedMove(m)
+			if err != nil {
+				T.Fatalf("Unexpected error: %s\n", err.Error())
+			}
+		}
+	}
+	if count := gs.RepetitionCount(); count != 3 {
+		T.Errorf("Repetition count is %d, expected 3\n", count)
+	}
+	if reason := gs.ClaimableDraw(); reason != ThreefoldRepetition {
+		T.Errorf("Claimable draw is %q, expected %q\n", reason, ThreefoldRepetition)
+	}
+	if gs.IsFivefoldRepetition() {
+		T.Errorf("Fivefold repetition reported after three occurrences\n")
+	}
+}
+
+func TestAutomaticDraw(T *testing.T) {
+	tests := []struct {
+		FEN       string
+		Claimable DrawReason
+		Automatic DrawReason
+	}{
+		{FEN: "8/8/4k3/8/8/3K4/8/8 w - - 0 40", Automatic: InsufficientMaterial},
+		{FEN: "8/8/4k3/8/8/3KN3/8/8 w - - 0 40", Automatic: InsufficientMaterial},
+		{FEN: "8/8/3bk3/8/8/3KB3/8/8 w - - 0 40", Automatic: InsufficientMaterial},
+		{FEN: "8/8/2b1k3/8/8/3KB3/8/8 w - - 0 40"},
+		{FEN: "8/8/4k3/8/8/2NKN3/8/8 w - - 0 40"},
+		{FEN: "8/8/4k3/8/8/3KR3/8/8 w - - 100 90", Claimable: FiftyMoveRule},
+		{FEN: "8/8/4k3/8/8/3KR3/8/8 w - - 150 115", Claimable: FiftyMoveRule, Automatic: SeventyFiveMoveRule},
+	}
+
+	for _, test := range tests {
+		gs, err := NewGameState(test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if reason := gs.ClaimableDraw(); reason != test.Claimable {
+			T.Errorf("Claimable draw for %s is %q, expected %q\n", test.FEN, reason, test.Claimable)
+		}
+		if reason := gs.AutomaticDraw(); reason != test.Automatic {
+			T.Errorf("Automatic draw for %s is %q, expected %q\n", test.FEN, reason, test.Automatic)
+		}
+	}
+}
+
+func TestChess960(T *testing.T) {
+	perftTests := []struct {
+		FEN   string
+		XFEN  string
+		Nodes int
+	}{
+		{
+			FEN:   "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w HFhf - 2 9",
+			XFEN:  "bqnb1rkr/pp3ppp/3ppn2/2p5/5P2/P2P4/NPP1P1PP/BQ1BNRKR w KQkq - 2 9",
+			Nodes: 528,
+		},
+		{
+			FEN:   "b1q1rrkb/pppppppp/3nn3/8/P7/1PPP4/4PPPP/BQNNRKRB w GE - 1 9",
+			XFEN:  "b1q1rrkb/pppppppp/3nn3/8/P7/1PPP4/4PPPP/BQNNRKRB w KQ - 1 9",
+			Nodes: 479,
+		},
+		{
+			FEN:   "qbbnnrkr/2pp2pp/p7/1p2pp2/8/P3PP2/1PPP1KPP/QBBNNR1R w hf - 0 9",
+			XFEN:  "qbbnnrkr/2pp2pp/p7/1p2pp2/8/P3PP2/1PPP1KPP/QBBNNR1R w kq - 0 9",
+			Nodes: 593,
+		},
+	}
+	for _, test := range perftTests {
+		gs, err := NewGameState(test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if !gs.Chess960 {
+			T.Errorf("%s was not recognised as Chess960\n", test.FEN)
+		}
+		if fen := gs.FEN(); fen != test.XFEN {
+			T.Errorf("FEN %s does not match expected: %s\n", fen, test.XFEN)
+		}
+		if nodes := perft(gs, 2); nodes != test.Nodes {
+			T.Errorf("Perft(2) of %s is %d, expected %d\n", test.FEN, nodes, test.Nodes)
+		}
+	}
+
+	castleTests := []struct {
+		FEN      string
+		Move     string
+		Extended string
+		FENAfter string
+	}{
+		{
+			FEN:      "r3k2r/8/8/8/8/8/8/R3K2R w KQkq - 0 1",
+			Move:     "O-O",
+			Extended: "e1g1",
+			FENAfter: "r3k2r/8/8/8/8/8/8/R4RK1 b kq - 1 1",
+		},
+		{
+			FEN:      "1r4kr/8/8/8/8/8/8/1R4KR w KQkq - 0 1",
+			Move:     "O-O",
+			Extended: "g1h1",
+			FENAfter: "1r4kr/8/8/8/8/8/8/1R3RK1 b kq - 1 1",
+		},
+		{
+			FEN:      "1r4kr/8/8/8/8/8/8/1R4KR w KQkq - 0 1",
+			Move:     "O-O-O",
+			Extended: "g1b1",
+			FENAfter: "1r4kr/8/8/8/8/8/8/2KR3R b kq - 1 1",
+		},
+	}
+	for _, test := range castleTests {
+		gs, err := NewGameState(test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		next, extended, err := gs.ApplyAndTranslateMove(test.Move, gs.PlayerTurn)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if extended != test.Extended {
+			T.Errorf("Extended move %s does not match expected: %s\n", extended, test.Extended)
+		}
+		if fen := next.FEN(); fen != test.FENAfter {
+			T.Errorf("FEN %s does not match expected: %s\n", fen, test.FENAfter)
+		}
+		move, err := gs.ExtendedStringToMove(extended)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if san := move.MoveToStandardNotation(); san != test.Move {
+			T.Errorf("Move %s does not match expected: %s\n", san, test.Move)
+		}
+	}
+}
+
+func TestSANDisambiguation(T *testing.T) {
+	tests := []struct {
+		FEN      string
+		Extended string
+		SAN      string
+	}{
+		// The knight on e2 is pinned, so it does not count
+		{FEN: "4r1k1/8/8/1N6/8/8/4N3/4K3 w - - 0 1", Extended: "b5d4", SAN: "Nd4"},
+		{FEN: "6k1/8/8/1N6/8/8/4N3/4K3 w - - 0 1", Extended: "b5d4", SAN: "Nbd4"},
+		{FEN: "4k3/8/8/R7/8/8/8/R3K3 w - - 0 1", Extended: "a1a3", SAN: "R1a3"},
+		{FEN: "4k3/8/8/R7/8/8/8/R3K3 w - - 0 1", Extended: "a5a3", SAN: "R5a3"},
+		{FEN: "4k3/8/8/8/8/2Q5/8/Q1Q1K3 w - - 0 1", Extended: "a1b2", SAN: "Qab2"},
+		{FEN: "4k3/8/8/8/8/2Q5/8/Q1Q1K3 w - - 0 1", Extended: "c3b2", SAN: "Q3b2"},
+		{FEN: "4k3/8/8/8/8/2Q5/8/Q1Q1K3 w - - 0 1", Extended: "c1b2", SAN: "Qc1b2"},
+		{FEN: "3r2k1/4P3/8/8/8/8/8/4K3 w - - 0 1", Extended: "e7d8q", SAN: "exd8=Q+"},
+		{FEN: "4k3/8/8/3pP3/8/8/8/4K3 w - d6 0 1", Extended: "e5d6", SAN: "exd6"},
+	}
+
+	for _, test := range tests {
+		gs, err := NewGameState(test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		move, err := gs.ExtendedStringToMove(test.Extended)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if san := move.MoveToStandardNotation(); san != test.SAN {
+			T.Errorf("Move %s in %s is %s, expected %s\n", test.Extended, test.FEN, san, test.SAN)
+		}
+		_, extended, err := gs.ApplyAndTranslateMove(test.SAN, gs.PlayerTurn)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if extended != test.Extended {
+			T.Errorf("Extended move %s does not match expected: %s\n", extended, test.Extended)
+		}
+	}
+
+	gs, _ := NewGameState("6k1/8/8/1N6/8/8/4N3/4K3 w - - 0 1")
+	if _, _, err := gs.ApplyAndTranslateMove("Nd4", gs.PlayerTurn); err == nil {
+		T.Errorf("Expected an error for the ambiguous move Nd4\n")
+	}
+}
+
+// TestSANRoundTrip replays each game in testdata/san_games.txt, which holds
+// one game per line in the same format as the moves field of the lichess
+// API, and checks that every move converts back to the same SAN. A game
+// from a set up position is preceded by its variant and initial FEN, each
+// followed by a tab.
+func TestSANRoundTrip(T *testing.T) {
+	file, err := os.Open("testdata/san_games.txt")
+	if err != nil {
+		T.Fatalf("Unable to open corpus: %s\n", err.Error())
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		variant, fen, moves := "standard", standardStartingFEN, scanner.Text()
+		if fields := strings.Split(moves, "\t"); len(fields) == 3 {
+			variant, fen, moves = fields[0], fields[1], fields[2]
+		}
+		v, found := LookupVariant(variant)
+		if !found {
+			T.Fatalf("Game %d: unknown variant %s\n", line, variant)
+		}
+		gs, err := NewVariantGameState(v, fen)
+		if err != nil {
+			T.Fatalf("Game %d: unexpected error: %s\n", line, err.Error())
+		}
+		for ply, ms := range strings.Fields(moves) {
+			next, extended, err := gs.ApplyAndTranslateMove(ms, gs.PlayerTurn)
+			if err != nil {
+				T.Errorf("Game %d ply %d: unable to apply %s: %s\n", line, ply+1, ms, err.Error())
+				break
+			}
+			move, err := gs.ExtendedStringToMove(extended)
+			if err != nil {
+				T.Errorf("Game %d ply %d: unable to translate %s: %s\n", line, ply+1, extended, err.Error())
+				break
+			}
+			if san := move.MoveToStandardNotation(); san != ms {
+				T.Errorf("Game %d ply %d: %s came back as %s\n", line, ply+1, ms, san)
+			}
+			gs = next
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		T.Errorf("Unable to read corpus: %s\n", err.Error())
+	}
+}
+
+func TestPVToStandard(T *testing.T) {
+	gs, _ := NewGameState(standardStartingFEN)
+	moves, repetition := gs.PVToStandard([]string{"e2e4", "e7e5", "g1f3", "b8c6", "f1b5"})
+	if !reflect.DeepEqual(moves, []string{"e4", "e5", "Nf3", "Nc6", "Bb5"}) || repetition {
+		T.Errorf("Line %v does not match expected\n", moves)
+	}
+
+	// The knights return home twice, repeating the starting position
+	shuffle := []string{"g1f3", "g8f6", "f3g1", "f6g8", "g1f3", "g8f6", "f3g1", "f6g8", "e2e4"}
+	moves, repetition = gs.PVToStandard(shuffle)
+	if len(moves) != 8 || !repetition {
+		T.Errorf("Line %v should stop at the repetition\n", moves)
+	}
+
+	// A line starting with a drop is read from its first move
+	v, _ := LookupVariant("crazyhouse")
+	zh, _ := NewVariantGameState(v, "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKB1R[N] w KQkq - 0 1")
+	pv, _ := GetPVMoves(strings.Fields("info depth 12 multipv 1 score cp 80 nodes 5000 pv N@f3 e7e5 f3e5"))
+	moves, _ = zh.PVToStandard(pv)
+	if !reflect.DeepEqual(moves, []string{"N@f3", "e5", "Nxe5"}) {
+		T.Errorf("Crazyhouse line %v (from %v) does not match expected\n", moves, pv)
+	}
+
+	info := strings.Fields("info depth 20 seldepth 28 score cp 35 nodes 100 pv e7e5")
+	if score := GetScore(info, Black); score == nil || *score.Eval != -35 {
+		T.Errorf("Score %+v does not match expected -35\n", score)
+	}
+	info = strings.Fields("info depth 20 score mate -3 pv e7e5")
+	if score := GetScore(info, White); score == nil || *score.Mate != -3 {
+		T.Errorf("Score %+v does not match expected mate in -3\n", score)
+	}
+}
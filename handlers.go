@@ -2,42 +2,181 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/fs"
 	"log"
-	"maps"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+
+	"github.com/theMagicRabbit/lichan/internal/config"
 )
 
-func (s *state) handlerDownloads(username string) error {
-	opts := "opening=true&sort=dateAsc"
-	reqUrl := fmt.Sprintf("%s%s%s?%s", s.ApiUrl, "/api/games/user/", username, opts)
+// handlerSync downloads and analyzes the games of each user. Every user is
+// tried, and the errors of those that failed are returned together.
+func (s *state) handlerSync(users []string) error {
+	err := s.Config.CreateDirs()
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	download := true
+	for _, user := range users {
+		if download {
+			err = s.handlerDownloads(user)
+			if err != nil {
+				log.Printf("Unable to download games for %s: %v\n", user, err)
+				errs = append(errs, fmt.Errorf("%s: %w", user, err))
+				// A bad token fails the same way for every user
+				download = !errors.Is(err, ErrUnauthorized)
+			}
+		}
+		err = s.handlerAnalyze(user)
+		if err != nil {
+			log.Printf("Unable to analyze games for %s: %v\n", user, err)
+			errs = append(errs, fmt.Errorf("%s: %w", user, err))
+			continue
+		}
+		if s.Config.Study != "" {
+			err = s.handlerPush([]string{user})
+			if err != nil {
+				log.Printf("Unable to push games for %s: %v\n", user, err)
+				errs = append(errs, fmt.Errorf("%s: %w", user, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// handlerResync downloads the whole history of each user again, saving the
+// games that are missing and analyzing them.
+func (s *state) handlerResync(users []string) error {
+	for _, user := range users {
+		if !slices.ContainsFunc(s.Config.Username, func(u string) bool { return strings.EqualFold(u, user) }) {
+			return fmt.Errorf("%s is not one of the configured usernames", user)
+		}
+		s.Cursors.Reset(user)
+	}
+	err := s.checkpoint()
+	if err != nil {
+		return err
+	}
+	return s.handlerSync(users)
+}
+
+// downloadQuery builds the parameters of a game export. Games start after
+// the last one saved, or at the filter's since when that is later.
+func downloadQuery(filter config.DownloadFilter, lastGameTime int64) (opts url.Values, err error) {
+	opts = url.Values{}
+	for _, opt := range []string{"opening", "clocks", "evals", "accuracy"} {
+		opts.Set(opt, "true")
+	}
+	opts.Set("sort", "dateAsc")
 
-	if s.Config.LastGameTime > 0 {
-		reqUrl = fmt.Sprintf("%s&since=%d", reqUrl, s.Config.LastGameTime)
+	since, err := config.ParseDownloadTime(filter.Since)
+	if err != nil {
+		return
+	}
+	if lastGameTime > 0 {
+		// since is inclusive, and the last game is already saved
+		since = max(since, lastGameTime+1)
+	}
+	if since > 0 {
+		opts.Set("since", strconv.FormatInt(since, 10))
+	}
+	until, err := config.ParseDownloadTime(filter.Until)
+	if err != nil {
+		return
+	}
+	if until > 0 {
+		opts.Set("until", strconv.FormatInt(until, 10))
+	}
+
+	if len(filter.PerfType) > 0 {
+		opts.Set("perfType", strings.Join(filter.PerfType, ","))
+	}
+	if filter.Color != "" {
+		opts.Set("color", filter.Color)
+	}
+	if filter.Vs != "" {
+		opts.Set("vs", filter.Vs)
+	}
+	if filter.Max > 0 {
+		opts.Set("max", strconv.Itoa(filter.Max))
+	}
+	for name, value := range map[string]*bool{
+		"rated":    filter.Rated,
+		"analysed": filter.Analysed,
+		"ongoing":  filter.Ongoing,
+		"finished": filter.Finished,
+	} {
+		if value != nil {
+			opts.Set(name, strconv.FormatBool(*value))
+		}
 	}
+	return
+}
 
-	req, err := http.NewRequest("GET", reqUrl, nil)
+func (s *state) handlerDownloads(username string) error {
+	filter := s.Config.DownloadFilter(username).Override(s.Filter)
+	opts, err := downloadQuery(filter, s.Cursors.Get(username, gamesSource))
 	if err != nil {
 		return err
 	}
 
-	req.Header.Add("authorization", fmt.Sprintf("Bearer %s", s.Config.PAT))
-	req.Header.Add("accept", "application/x-ndjson")
-	res, err := http.DefaultClient.Do(req)
+	req, err := s.Lichess.NewRequest(context.Background(), http.MethodGet, "/api/games/user/"+url.PathEscape(username), opts, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/x-ndjson")
+	res, err := s.Lichess.Do(req)
 	if err != nil {
 		return err
 	}
 	defer res.Body.Close()
 
-	var games []Game
-	gamesScaner := bufio.NewScanner(res.Body)
+	// The cursor stays before a game in progress, so it is downloaded again
+	// once it has finished.
+	inProgress := false
+	outputDir := filepath.Join(s.Config.GameDirectory, username)
+	downloaded, err := s.saveGames(res.Body, outputDir, func(game *Game, finished bool) error {
+		inProgress = inProgress || !finished
+		if inProgress {
+			return nil
+		}
+		s.Cursors.Set(username, gamesSource, game.CreatedAt)
+		return s.checkpoint()
+	})
+	log.Printf("Downloaded %d games for %s\n", downloaded, username)
+	return err
+}
 
+// saveGames saves each finished game of an NDJSON stream to the archive and
+// a PGN file in outputDir as it arrives, so a broken connection only loses
+// the games lichess had not sent yet. Games already archived are skipped.
+// after, when given, is called for every game in the order they arrive.
+func (s *state) saveGames(stream io.Reader, outputDir string, after func(game *Game, finished bool) error) (downloaded int, err error) {
+	archived, err := readArchive(archivePath(outputDir))
+	if err != nil {
+		return
+	}
+	// A resync sends games that are already saved
+	saved := make(map[string]bool)
+	for _, game := range archived {
+		saved[game.ID] = true
+	}
+
+	gamesScaner := bufio.NewScanner(stream)
+	gamesScaner.Buffer(nil, maxArchiveLine)
 	for gamesScaner.Scan() {
 		gameBytes := gamesScaner.Bytes()
 		game := Game{}
@@ -46,24 +185,46 @@ func (s *state) handlerDownloads(username string) error {
 			log.Printf("Error unmarshaling game: %v\n", err)
 			continue
 		}
-		games = append(games, game)
+		finished := game.Status != "created" && game.Status != "started"
+
+		if finished && !saved[game.ID] {
+			// The archive keeps everything lichess sent for the analysis
+			err = appendToArchive(archivePath(outputDir), gameBytes)
+			if err != nil {
+				return
+			}
+			err = game.WriteGame(s, outputDir)
+			if err != nil {
+				return
+			}
+			saved[game.ID] = true
+			downloaded++
+		}
+		if after != nil {
+			err = after(&game, finished)
+			if err != nil {
+				return
+			}
+		}
 	}
 
 	err = gamesScaner.Err()
 	if err != nil {
 		log.Printf("Error scanning for games: %v\n", err)
 	}
+	return
+}
 
-	for _, game := range games {
-		outputDir := filepath.Join(s.Config.GameDirectory, username)
-		err := game.WriteGame(s, outputDir)
-		if err != nil {
-			return err
-		}
-		s.Config.LastGameTime = game.CreatedAt
-	}
+// gamesSource is the cursor of a user's own games
+const gamesSource = "games"
 
-	return nil
+// checkpoint saves the cursors, so the next run carries on after the last
+// game saved.
+func (s *state) checkpoint() error {
+	if s.StatePath == "" {
+		return nil
+	}
+	return s.Cursors.Write(s.StatePath)
 }
 
 func (s *state) handlerAnalyze(username string) error {
@@ -78,120 +239,362 @@ func (s *state) handlerAnalyze(username string) error {
 		return err
 	}
 
-	// START LOOP
+	err = os.MkdirAll(engineGames, 0755)
+	if err != nil {
+		log.Printf("Unable to create engine directory: %v\n", err)
+		return err
+	}
+
+	// Downloaded games are analyzed from the archive, which has everything
+	// lichess sent, rather than from their PGN files.
+	archived, err := readArchive(archivePath(userGames))
+	if err != nil {
+		log.Printf("Unable to read game archive: %v\n", err)
+	}
+	fromArchive := make(map[string]bool)
+	engines := newEnginePool(s.Config.Engine, s.Config.VariantEngine)
+	defer engines.Close()
+	for _, game := range archived {
+		gameFile := game.pgnFileName()
+		fromArchive[gameFile] = true
+		enginePath := filepath.Join(engineGames, engineFileName(gameFile))
+		if analyzed(enginePath) {
+			continue
+		}
+
+		err = s.analyzeGame(game, engines)
+		if err != nil {
+			log.Printf("%s | Skipping game: %v\n", game.ID, err)
+			continue
+		}
+		err = reportComparison(engineGames, game, compareAnalysis(game))
+		if err != nil {
+			log.Printf("%s | Unable to compare with the lichess analysis: %v\n", game.ID, err)
+		}
+		gamePGN, err := GameToPGN(game, s.SiteUrl)
+		if err != nil {
+			log.Printf("%s | Skipping game: %v\n", game.ID, err)
+			continue
+		}
+		err = writeFileAtomic(enginePath, []byte(gamePGN))
+		if err != nil {
+			log.Printf("%s | Unable to write analysis: %v\n", game.ID, err)
+			continue
+		}
+		log.Printf("Wrote %s\n", enginePath)
+	}
+
 	for _, file := range files {
 		gameFile := file.Name()
-		if file.IsDir() || strings.ToLower(filepath.Ext(gameFile)) != ".pgn" {
+		if file.IsDir() || strings.ToLower(filepath.Ext(gameFile)) != ".pgn" || fromArchive[gameFile] {
 			continue
 		}
 		gamePath := filepath.Join(userGames, gameFile)
-		engineFile := strings.ToLower(strings.TrimSuffix(gameFile, filepath.Ext(gameFile)) + "_stockfish.pgn")
-		enginePath := filepath.Join(engineGames, engineFile)
-		_, err := os.Stat(enginePath)
-		if err == nil {
-			// if the file exists, assume that the game has already been processed
+		enginePath := filepath.Join(engineGames, engineFileName(gameFile))
+		if analyzed(enginePath) {
 			continue
-		} else {
-			if !errors.Is(err, fs.ErrNotExist) {
-				// If the error is anything other than the file not existing, log the error and skip
-				log.Printf("Error accessing engine path: %v\n", err)
-				continue
-			}
 		}
 
-		gamePGNBytes, err := os.ReadFile(gamePath)
+		err = s.analyzeFile(gamePath, enginePath, nil)
+		if err != nil {
+			log.Printf("Unable to analyze %s: %v\n", gamePath, err)
+		}
+	}
+	return nil
+}
+
+func engineFileName(gameFile string) string {
+	return strings.ToLower(strings.TrimSuffix(gameFile, filepath.Ext(gameFile)) + "_stockfish.pgn")
+}
+
+// analyzed reports whether the analysis at enginePath has been written
+func analyzed(enginePath string) bool {
+	_, err := os.Stat(enginePath)
+	if err == nil {
+		// if the file exists, assume that the game has already been processed
+		return true
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		// If the error is anything other than the file not existing, log the error and skip
+		log.Printf("Error accessing engine path: %v\n", err)
+		return true
+	}
+	return false
+}
+
+// writeFileAtomic writes through a temporary file, so an interrupted run
+// never leaves a partial file behind.
+func writeFileAtomic(path string, data []byte) error {
+	partPath := path + ".part"
+	err := os.WriteFile(partPath, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(partPath, path)
+}
+
+// fileProgress is saved next to the output of analyzeFile after each game
+// written, so an interrupted run resumes after the last of them rather than
+// starting the file over.
+type fileProgress struct {
+	// Read is the number of games read from the start of the file
+	Read     int `json:"read"`
+	Analyzed int `json:"analyzed"`
+	Skipped  int `json:"skipped"`
+	Filtered int `json:"filtered"`
+	// Size is the length of the output holding the analyzed games
+	Size   int64       `json:"size"`
+	Filter *GameFilter `json:"filter,omitempty"`
+}
+
+// resumeFile returns the progress of an interrupted analysis of a file, or
+// no progress if there is none to pick up again.
+func resumeFile(progressPath, partPath string, filter *GameFilter) (progress fileProgress) {
+	progressBytes, err := os.ReadFile(progressPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(progressBytes, &progress)
+	}
+	if err != nil {
+		log.Printf("Unable to read %s, starting over: %v\n", progressPath, err)
+		return fileProgress{}
+	}
+	info, err := os.Stat(partPath)
+	if err != nil || info.Size() < progress.Size {
+		log.Printf("%s is missing or shorter than recorded, starting over\n", partPath)
+		return fileProgress{}
+	}
+	saved, _ := json.Marshal(progress.Filter)
+	current, _ := json.Marshal(filter)
+	if string(saved) != string(current) {
+		log.Printf("%s was started with other filters, starting over\n", partPath)
+		return fileProgress{}
+	}
+	return
+}
+
+// analyzeFile analyzes every game in a PGN file, which may be a whole
+// database, and writes the annotated games to outputPath. A game that
+// cannot be read or analyzed is logged and left out of the output, as is a
+// game that does not pass the filter.
+func (s *state) analyzeFile(gamePath, outputPath string, filter *GameFilter) error {
+	in, err := openPGN(gamePath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	// Write to a temporary file, which is kept with the progress made when
+	// the run is interrupted
+	partPath := outputPath + ".part"
+	progressPath := outputPath + ".progress"
+	progress := resumeFile(progressPath, partPath, filter)
+	progress.Filter = filter
+	out, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	// Drop whatever was written after the last game recorded
+	err = out.Truncate(progress.Size)
+	if err != nil {
+		return err
+	}
+	_, err = out.Seek(progress.Size, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(out)
+
+	engines := newEnginePool(s.Config.Engine, s.Config.VariantEngine)
+	defer engines.Close()
+	reader := NewPGNReader(in)
+	if progress.Read > 0 {
+		log.Printf("Resuming %s after %d games\n", gamePath, progress.Read)
+	}
+	for range progress.Read {
+		_, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+	}
+	for {
+		pgnGame, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		progress.Read++
 		if err != nil {
-			log.Printf("Error reading game PNG file: %v\n", err)
+			log.Printf("%s | Skipping game: %v\n", gamePath, err)
+			progress.Skipped++
 			continue
 		}
 
-		game, err := GameFromPGN(gamePGNBytes)
+		game := pgnGame.ToGame()
+		if filter != nil && len(filter.ECO) > 0 {
+			// Games without an ECO tag are classified to filter them by opening
+			game.classifyOpening()
+		}
+		if !filter.Match(game) {
+			progress.Filtered++
+			continue
+		}
+		err = s.analyzeGame(game, engines)
 		if err != nil {
-			return err
+			log.Printf("%s:%d | Skipping game: %v\n", gamePath, pgnGame.Line, err)
+			progress.Skipped++
+			continue
 		}
-		if game.InitalFEN == "" {
-			game.InitalFEN = standardStartingFEN
+		err = reportComparison(filepath.Dir(outputPath), game, compareAnalysis(game))
+		if err != nil {
+			log.Printf("%s:%d | Unable to compare with the lichess analysis: %v\n", gamePath, pgnGame.Line, err)
 		}
 
-		var gs *GameState
-		stockfish, err := InitStockfish()
+		gamePGN, err := GameToPGN(game, s.SiteUrl)
 		if err != nil {
-			log.Printf("Unable to start stockfish: %v\n", err)
-			break
+			log.Printf("%s:%d | Skipping game: %v\n", gamePath, pgnGame.Line, err)
+			progress.Skipped++
+			continue
 		}
-
-		go stockfish.ProcessOutput()
-		stockfish.Cmd.Start()
-
-		_, err = stockfish.Stdin.Write([]byte("uci\n"))
+		if progress.Analyzed > 0 {
+			gamePGN = "\n" + gamePGN
+		}
+		_, err = writer.WriteString(gamePGN)
 		if err != nil {
-			log.Printf("Unable to send commands to stockfish: %v\n", err)
-			break
+			return err
 		}
-		<-stockfish.Ready
+		progress.Analyzed++
 
-		err = stockfish.SetupGame(game.InitalFEN)
+		err = writer.Flush()
 		if err != nil {
-			log.Printf("Game setup failed: %v\n", err)
-			break
+			return err
 		}
-		<-stockfish.Ready
-
-		var analyzedMoves string
-		var turnCounter int = 1
-		for ms := range strings.SplitSeq(game.Moves, " ") {
-			if gs == nil {
-				gs, err = NewGameState(game.InitalFEN)
-				if err != nil {
-					log.Printf("Unable to parse FEN: %v\n", err)
-					break
-				}
-			}
+		progress.Size, err = out.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		progressBytes, err := json.Marshal(progress)
+		if err != nil {
+			return err
+		}
+		err = writeFileAtomic(progressPath, progressBytes)
+		if err != nil {
+			return err
+		}
+	}
 
-			if gs.PlayerTurn == Black {
-				analyzedMoves = fmt.Sprintf("%s %s", analyzedMoves, ms)
-				turnCounter++
-			} else {
-				analyzedMoves = fmt.Sprintf("%s %d. %s", analyzedMoves, turnCounter, ms)
-			}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(partPath, outputPath)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(progressPath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if filter != nil {
+		log.Printf("Wrote %d analyzed games to %s, skipped %d, filtered out %d\n", progress.Analyzed, outputPath, progress.Skipped, progress.Filtered)
+	} else {
+		log.Printf("Wrote %d analyzed games to %s, skipped %d\n", progress.Analyzed, outputPath, progress.Skipped)
+	}
+	return nil
+}
 
-			var extendedMoveString string
-			gs, extendedMoveString, err = gs.ApplyAndTranslateMove(ms, gs.PlayerTurn)
-			if err != nil {
-				log.Printf("%s | Unable to parse move %s: %v\n", game.ID, ms, err)
-				break
-			}
-			stockfish.SearchMove(extendedMoveString)
-			bestmove := <-stockfish.Bestmove
-
-			stockfish.Info.Mu.Lock()
-			moveInfo := stockfish.Info.Value
-			stockfish.Info.Mu.Unlock()
-
-			pv, _ := GetPVMoves(moveInfo)
-			var pvPGNMoves string
-			var pvMoveCounter int = turnCounter
-			var pvGameState *GameState = &GameState{
-				PlayerTurn: gs.PlayerTurn,
-				Pieces: make(map[string]piece),
-			}
-			maps.Copy(pvGameState.Pieces, gs.Pieces)
+// analyzeGame runs an engine of the pool over every move of the game,
+// recording its evaluation on each move and its line as a variation
+// wherever it prefers a different move to the one played.
+func (s *state) analyzeGame(game *Game, engines *enginePool) (err error) {
+	variant, found := LookupVariant(game.Variant)
+	if !found {
+		err = fmt.Errorf("variant %q is not supported", game.Variant)
+		return
+	}
+	if game.InitalFEN == "" {
+		game.InitalFEN = variant.StartingFEN()
+	}
+	if s.Config.SkipServerAnalyzed && game.hasServerAnalysis() {
+		log.Printf("%s | Keeping the lichess analysis\n", game.ID)
+		game.classifyOpening()
+		return
+	}
 
-			pvPGNMoves, err = pvGameState.PVMovesToStandard(pv, pvMoveCounter, pvGameState.PlayerTurn)
-			if err != nil {
-				log.Printf("Unable to calculate PV string: %v\n", err)
-				break
-			}
+	stockfish, err := engines.get(variant)
+	if err != nil {
+		return
+	}
 
+	err = stockfish.SetupGame(game.InitalFEN)
+	if err != nil {
+		err = fmt.Errorf("game setup failed: %w", err)
+		return
+	}
+	<-stockfish.Ready
 
-			if pvPGNMoves != "" {
-				analyzedMoves = analyzedMoves + " " + pvPGNMoves
-			}
-			fmt.Println("Best move:", bestmove, "analyzed move string:", analyzedMoves)
+	gs, err := NewVariantGameState(variant, game.InitalFEN)
+	if err != nil {
+		err = fmt.Errorf("unable to parse FEN: %w", err)
+		return
+	}
+
+	// Imported games and games from a set up position come without an
+	// opening, and games read from PGN without the ply theory ends on
+	game.classifyOpening()
+
+	ply := 0
+	claim := NoDraw
+	for node := game.MoveTree(); len(node.Children) > 0; {
+		node = node.Children[0]
+		ply++
+		if game.Opening.Ply > 0 && ply == game.Opening.Ply+1 {
+			node.Comments = append(node.Comments, fmt.Sprintf("Leaves known theory after %s %s", game.Opening.Eco, game.Opening.Name))
 		}
 
-		// Write output to processed file
+		var extendedMoveString string
+		gs, extendedMoveString, err = gs.ApplyAndTranslateMove(node.Move, gs.PlayerTurn)
+		if err != nil {
+			err = fmt.Errorf("unable to parse move %s: %w", node.Move, err)
+			return
+		}
+		// A claim stays open once available, so it is noted when it opens
+		reason := gs.ClaimableDraw()
+		if reason != NoDraw && reason != claim {
+			node.Comments = append(node.Comments, fmt.Sprintf("Draw could be claimed by %s", reason))
+		}
+		claim = reason
+		stockfish.SearchMove(extendedMoveString)
+		<-stockfish.Bestmove
+
+		stockfish.Info.Mu.Lock()
+		moveInfo := stockfish.Info.Value
+		stockfish.Info.Mu.Unlock()
+
+		// A mated position has no evaluation worth writing
+		if score := GetScore(moveInfo, gs.PlayerTurn); score != nil && (score.Mate == nil || *score.Mate != 0) {
+			node.Eval = score
+		}
+
+		// The engine's line replaces the next move, so there is nowhere to
+		// put it after the last move or when it agrees with the game.
+		pv, _ := GetPVMoves(moveInfo)
+		pvMoves, repetition := gs.PVToStandard(pv)
+		if len(pvMoves) == 0 || len(node.Children) == 0 || node.Children[0].Move == pvMoves[0] {
+			continue
+		}
+		last := node.AddVariation(pvMoves)
+		if repetition {
+			last.Comments = append(last.Comments, string(ThreefoldRepetition))
+		}
 	}
-	// STOP LOOP
-	return nil
+
+	game.SetStatusFromState(gs)
+	return
 }
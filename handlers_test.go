@@ -0,0 +1,239 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/theMagicRabbit/lichan/internal/config"
+)
+
+// fakeLichess serves the game export of a lichess instance from a list of
+// NDJSON lines, honouring since, until and max like lichess does.
+type fakeLichess struct {
+	sync.Mutex
+	Token string
+	Games []fakeGame
+	// Since records the since of every export requested
+	Since []string
+}
+
+type fakeGame struct {
+	CreatedAt int64
+	Line      string
+}
+
+func gameLine(id string, createdAt int64) fakeGame {
+	return fakeGame{createdAt, fmt.Sprintf(`{"id":"%s","createdAt":%d,"status":"mate","players":{"white":{"user":{"name":"alice"}},"black":{"user":{"name":"bob"}}},"moves":"e4 e5"}`, id, createdAt)}
+}
+
+func (f *fakeLichess) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	if r.Header.Get("Authorization") != "Bearer "+f.Token {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"No such token"}`))
+		return
+	}
+	if !strings.HasPrefix(r.URL.Path, "/api/games/user/") {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	f.Since = append(f.Since, query.Get("since"))
+	since, _ := strconv.ParseInt(query.Get("since"), 10, 64)
+	until, _ := strconv.ParseInt(query.Get("until"), 10, 64)
+	limit, _ := strconv.Atoi(query.Get("max"))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	sent := 0
+	for _, game := range f.Games {
+		if game.CreatedAt < since || (until > 0 && game.CreatedAt > until) {
+			continue
+		}
+		if limit > 0 && sent == limit {
+			break
+		}
+		w.Write([]byte(game.Line + "\n"))
+		sent++
+	}
+}
+
+func TestHandlerDownloads(T *testing.T) {
+	type run struct {
+		// Added are the games lichess has gained since the last run
+		Added    []fakeGame
+		Filter   config.DownloadFilter
+		Since    string
+		Archived []string
+		Cursor   int64
+		Err      error
+	}
+	tests := []struct {
+		Name  string
+		Token string
+		Runs  []run
+	}{
+		{
+			Name:  "pagination by since",
+			Token: "secret",
+			Runs: []run{
+				{
+					Added:    []fakeGame{gameLine("aaaaaaaa", 1000), gameLine("bbbbbbbb", 2000), gameLine("cccccccc", 3000)},
+					Filter:   config.DownloadFilter{Max: 2},
+					Since:    "",
+					Archived: []string{"aaaaaaaa", "bbbbbbbb"},
+					Cursor:   2000,
+				},
+				{
+					Since:    "2001",
+					Archived: []string{"aaaaaaaa", "bbbbbbbb", "cccccccc"},
+					Cursor:   3000,
+				},
+				{
+					Added:    []fakeGame{gameLine("dddddddd", 4000)},
+					Since:    "3001",
+					Archived: []string{"aaaaaaaa", "bbbbbbbb", "cccccccc", "dddddddd"},
+					Cursor:   4000,
+				},
+			},
+		},
+		{
+			Name:  "malformed lines",
+			Token: "secret",
+			Runs: []run{
+				{
+					Added: []fakeGame{
+						gameLine("aaaaaaaa", 1000),
+						{1500, `{"id":"bbbbbbbb","createdAt":`},
+						{1600, `not json`},
+						{1700, ``},
+						gameLine("cccccccc", 2000),
+					},
+					Archived: []string{"aaaaaaaa", "cccccccc"},
+					Cursor:   2000,
+				},
+			},
+		},
+		{
+			Name:  "auth error",
+			Token: "wrong",
+			Runs: []run{
+				{
+					Added: []fakeGame{gameLine("aaaaaaaa", 1000)},
+					Err:   ErrUnauthorized,
+				},
+			},
+		},
+		{
+			Name:  "empty response",
+			Token: "secret",
+			Runs: []run{
+				{},
+				{
+					Added:    []fakeGame{gameLine("aaaaaaaa", 1000)},
+					Since:    "",
+					Archived: []string{"aaaaaaaa"},
+					Cursor:   1000,
+				},
+				{
+					Since:    "1001",
+					Archived: []string{"aaaaaaaa"},
+					Cursor:   1000,
+				},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		lichess := &fakeLichess{Token: "secret"}
+		server := httptest.NewServer(lichess)
+
+		dir := T.TempDir()
+		s := state{
+			Config:    &config.Config{GameDirectory: dir, Username: []string{"alice"}},
+			SiteUrl:   server.URL,
+			Lichess:   NewLichessClient(server.URL, test.Token),
+			Cursors:   &config.Cursors{Users: make(map[string]map[string]int64)},
+			StatePath: filepath.Join(dir, "state", "cursors.toml"),
+		}
+		s.Lichess.MaxRetries = 0
+		s.Config.CreateDirs()
+
+		for i, run := range test.Runs {
+			lichess.Lock()
+			lichess.Games = append(lichess.Games, run.Added...)
+			lichess.Since = nil
+			lichess.Unlock()
+			s.Filter = run.Filter
+
+			err := s.handlerDownloads("alice")
+			if !errors.Is(err, run.Err) {
+				T.Errorf("%s run %d: got error %v, expected %v\n", test.Name, i, err, run.Err)
+			}
+			if run.Err == nil && !slices.Equal(lichess.Since, []string{run.Since}) {
+				T.Errorf("%s run %d: requested since %q, expected %q\n", test.Name, i, lichess.Since, run.Since)
+			}
+
+			archived, err := readArchive(archivePath(filepath.Join(dir, "alice")))
+			if err != nil {
+				T.Errorf("%s run %d: unable to read archive: %v\n", test.Name, i, err)
+			}
+			var ids []string
+			for _, game := range archived {
+				ids = append(ids, game.ID)
+				pgn, err := os.ReadFile(filepath.Join(dir, "alice", game.pgnFileName()))
+				if err != nil {
+					T.Errorf("%s run %d: PGN of %s was not written: %v\n", test.Name, i, game.ID, err)
+				} else if site := fmt.Sprintf(`[Site "%s/%s"]`, server.URL, game.ID); !strings.Contains(string(pgn), site) {
+					T.Errorf("%s run %d: PGN of %s does not link to %s\n", test.Name, i, game.ID, site)
+				}
+			}
+			if !slices.Equal(ids, run.Archived) {
+				T.Errorf("%s run %d: archived %v, expected %v\n", test.Name, i, ids, run.Archived)
+			}
+
+			saved, err := config.ReadCursors(s.StatePath)
+			if err != nil || saved.Get("alice", gamesSource) != run.Cursor {
+				T.Errorf("%s run %d: saved cursor %d (%v), expected %d\n", test.Name, i, saved.Get("alice", gamesSource), err, run.Cursor)
+			}
+		}
+		server.Close()
+	}
+}
+
+func TestAnalyzeGameDrawClaims(T *testing.T) {
+	s, _ := fakeEngineState(T)
+	engines := newEnginePool(s.Config.Engine, s.Config.VariantEngine)
+	defer engines.Close()
+
+	// The fifty moves are up after 60... Kd8 and stay up for the rest of
+	// the game
+	game, err := GameFromPGN([]byte("[SetUp \"1\"]\n[FEN \"4k3/8/8/8/8/8/8/R3K3 w - - 98 60\"]\n\n60. Ra2 Kd8 61. Ra1 Ke8 62. Ra2 *\n"))
+	if err != nil {
+		T.Fatal(err)
+	}
+	err = s.analyzeGame(game, engines)
+	if err != nil {
+		T.Fatalf("Unable to analyze: %v\n", err)
+	}
+	var claims []int
+	for ply, node := range game.MoveTree().MainlineNodes() {
+		for _, comment := range node.Comments {
+			if strings.HasPrefix(comment, "Draw could be claimed") {
+				claims = append(claims, ply+1)
+			}
+		}
+	}
+	if !slices.Equal(claims, []int{2}) {
+		T.Errorf("Claims noted on plies %v, expected only 2\n", claims)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"compress/bzip2"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// GameFilter selects games from a database. Empty fields match every game.
+type GameFilter struct {
+	// Players matches games where either player is listed
+	Players []string
+	// MinRating and MaxRating must hold for both players
+	MinRating int
+	MaxRating int
+	Speeds    []string
+	// ECO matches codes by prefix, so "B9" selects the Najdorf
+	ECO []string
+}
+
+// Match reports whether the game passes the filter. A nil filter passes
+// every game.
+func (f *GameFilter) Match(g *Game) bool {
+	if f == nil {
+		return true
+	}
+	if len(f.Players) > 0 {
+		white, black := g.Players.White.User.Name, g.Players.Black.User.Name
+		if !slices.ContainsFunc(f.Players, func(p string) bool {
+			return strings.EqualFold(p, white) || strings.EqualFold(p, black)
+		}) {
+			return false
+		}
+	}
+	for _, rating := range []int{g.Players.White.Rating, g.Players.Black.Rating} {
+		if f.MinRating > 0 && rating < f.MinRating {
+			return false
+		}
+		if f.MaxRating > 0 && rating > f.MaxRating {
+			return false
+		}
+	}
+	if len(f.Speeds) > 0 && !slices.ContainsFunc(f.Speeds, func(s string) bool { return strings.EqualFold(s, g.Speed) }) {
+		return false
+	}
+	if len(f.ECO) > 0 && !slices.ContainsFunc(f.ECO, func(eco string) bool {
+		return g.Opening.Eco != "" && strings.HasPrefix(strings.ToUpper(g.Opening.Eco), strings.ToUpper(eco))
+	}) {
+		return false
+	}
+	return true
+}
+
+// openPGN opens a PGN file, decompressing it as it is read when it is a
+// bzip2 archive such as the lichess database dumps.
+func openPGN(path string) (r io.ReadCloser, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	if strings.ToLower(filepath.Ext(path)) != ".bz2" {
+		return file, nil
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{bzip2.NewReader(file), file}, nil
+}
+
+func splitList(list string) (items []string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+// handlerImport analyzes the games of downloaded database files that pass
+// the filters given as flags.
+func (s *state) handlerImport(args []string) error {
+	var filter GameFilter
+	var players, speeds, ecos string
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	flags.StringVar(&players, "player", "", "comma separated players, either of whom must play")
+	flags.IntVar(&filter.MinRating, "min-rating", 0, "lowest rating of both players")
+	flags.IntVar(&filter.MaxRating, "max-rating", 0, "highest rating of both players")
+	flags.StringVar(&speeds, "speed", "", "comma separated speeds, e.g. blitz,rapid")
+	flags.StringVar(&ecos, "eco", "", "comma separated ECO codes or prefixes, e.g. B90,C6")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: lichan import [flags] file.pgn.bz2...")
+		flags.PrintDefaults()
+	}
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("No files to import")
+	}
+	filter.Players = splitList(players)
+	filter.Speeds = splitList(speeds)
+	filter.ECO = splitList(ecos)
+
+	engineGames := filepath.Join(s.Config.EngineDirectory, "import")
+	err = os.MkdirAll(engineGames, 0755)
+	if err != nil {
+		log.Printf("Unable to create engine directory: %v\n", err)
+		return err
+	}
+
+	for _, gamePath := range flags.Args() {
+		gameFile := strings.TrimSuffix(filepath.Base(gamePath), ".bz2")
+		enginePath := filepath.Join(engineGames, engineFileName(gameFile))
+		err = s.analyzeFile(gamePath, enginePath, &filter)
+		if err != nil {
+			log.Printf("Unable to import %s: %v\n", gamePath, err)
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/theMagicRabbit/lichan/internal/config"
+)
+
+func TestImportFilter(T *testing.T) {
+	tests := []struct {
+		Name     string
+		Filter   *GameFilter
+		Expected []string
+	}{
+		{Name: "no filter", Expected: []string{"aaaaaaaa", "bbbbbbbb", "cccccccc"}},
+		{Name: "player", Filter: &GameFilter{Players: []string{"alice"}}, Expected: []string{"aaaaaaaa", "bbbbbbbb"}},
+		{Name: "rating", Filter: &GameFilter{MinRating: 1600, MaxRating: 2000}, Expected: []string{"bbbbbbbb"}},
+		{Name: "speed from clock", Filter: &GameFilter{Speeds: []string{"bullet", "classical"}}, Expected: []string{"bbbbbbbb", "cccccccc"}},
+		{Name: "eco prefix", Filter: &GameFilter{ECO: []string{"b9", "D3"}}, Expected: []string{"bbbbbbbb", "cccccccc"}},
+		{Name: "combined", Filter: &GameFilter{Players: []string{"ALICE"}, ECO: []string{"C6"}}, Expected: []string{"aaaaaaaa"}},
+	}
+
+	for _, test := range tests {
+		in, err := openPGN("testdata/database.pgn.bz2")
+		if err != nil {
+			T.Fatalf("Unable to open database: %s\n", err.Error())
+		}
+		reader := NewPGNReader(in)
+		var ids []string
+		for {
+			pgnGame, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				T.Fatalf("%s: unexpected error: %s\n", test.Name, err.Error())
+			}
+			if game := pgnGame.ToGame(); test.Filter.Match(game) {
+				site, _ := pgnGame.Tag("Site")
+				ids = append(ids, site[len(site)-8:])
+			}
+		}
+		in.Close()
+		if !slices.Equal(ids, test.Expected) {
+			T.Errorf("%s: matched %v, expected %v\n", test.Name, ids, test.Expected)
+		}
+	}
+}
+
+// fakeEngineState analyzes with testdata/fake-engine, which logs to the
+// file returned
+func fakeEngineState(T *testing.T) (s state, engineLog string) {
+	engineLog = filepath.Join(T.TempDir(), "engine.log")
+	T.Setenv("FAKE_ENGINE_LOG", engineLog)
+	engine, err := filepath.Abs("testdata/fake-engine")
+	if err != nil {
+		T.Fatal(err)
+	}
+	s = state{Config: &config.Config{Engine: engine, VariantEngine: engine}}
+	return
+}
+
+func TestAnalyzeFileReusesEngine(T *testing.T) {
+	s, engineLog := fakeEngineState(T)
+
+	outputPath := filepath.Join(T.TempDir(), "database_stockfish.pgn")
+	err := s.analyzeFile("testdata/database.pgn.bz2", outputPath, nil)
+	if err != nil {
+		T.Fatalf("Unable to analyze database: %v\n", err)
+	}
+
+	// One engine is started for the file, and told of each of its games
+	started, err := os.ReadFile(engineLog)
+	if err != nil {
+		T.Fatal(err)
+	}
+	expected := "start\nucinewgame\nucinewgame\nucinewgame\n"
+	if string(started) != expected {
+		T.Errorf("Engine log %q, expected %q\n", started, expected)
+	}
+}
+
+func TestAnalyzeFileResumes(T *testing.T) {
+	s, engineLog := fakeEngineState(T)
+
+	// An earlier run wrote the first game and was stopped while writing
+	// the second
+	outputPath := filepath.Join(T.TempDir(), "database_stockfish.pgn")
+	firstGame := "[Event \"first\"]\n\n1. e4 *\n"
+	err := os.WriteFile(outputPath+".part", []byte(firstGame+"\n[Event \"cut"), 0644)
+	if err != nil {
+		T.Fatal(err)
+	}
+	progress := fmt.Sprintf(`{"read":1,"analyzed":1,"size":%d}`, len(firstGame))
+	err = os.WriteFile(outputPath+".progress", []byte(progress), 0644)
+	if err != nil {
+		T.Fatal(err)
+	}
+
+	err = s.analyzeFile("testdata/database.pgn.bz2", outputPath, nil)
+	if err != nil {
+		T.Fatalf("Unable to analyze database: %v\n", err)
+	}
+
+	output, err := os.ReadFile(outputPath)
+	if err != nil {
+		T.Fatal(err)
+	}
+	if !strings.HasPrefix(string(output), firstGame+"\n[Event") || strings.Count(string(output), "[Event ") != 3 ||
+		strings.Contains(string(output), "cut") {
+		T.Errorf("Resumed output:\n%s\n", output)
+	}
+	// Only the games after the first are analyzed again
+	started, _ := os.ReadFile(engineLog)
+	if strings.Count(string(started), "ucinewgame") != 2 {
+		T.Errorf("Engine log %q, expected 2 games\n", started)
+	}
+	if _, err := os.Stat(outputPath + ".progress"); !os.IsNotExist(err) {
+		T.Errorf("Progress left after the file was finished: %v\n", err)
+	}
+}
@@ -2,7 +2,9 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"log"
+	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -10,27 +12,91 @@ import (
 	toml "github.com/pelletier/go-toml/v2"
 )
 
+// SchemaVersion is the current version of the config. Version 1, which a
+// file without a version follows, named the token and usernames token and
+// username, and kept the download cursor in the config as last_run.
+const SchemaVersion = 2
+
+// Config is read from the file the user edits and never written by lichan.
+// Keys it does not know are refused, so a misspelt key is not ignored.
 type Config struct {
-	Username      []string `toml:"username"`
-	GameDirectory string   `toml:"game_directory"`
-	EngineDirectory string `toml:"engine_directory"`
-	PAT           string   `toml:"token"`
-	LastGameTime  int64    `toml:"last_run"`
+	// Version is the schema the file follows, 1 when left out
+	Version         int      `toml:"version"`
+	Username        []string `toml:"usernames"`
+	GameDirectory   string   `toml:"game_directory"`
+	EngineDirectory string   `toml:"engine_directory"`
+	PAT             string   `toml:"pat"`
+	// APIURL is where lichess is reached and SiteURL where the games link
+	// to, so a self-hosted lila instance can be used. SiteURL defaults to
+	// APIURL.
+	APIURL  string `toml:"api_url"`
+	SiteURL string `toml:"site_url"`
+	// Engine is the UCI engine used for standard chess and Chess960, and
+	// VariantEngine the one used for the other lichess variants.
+	Engine        string `toml:"engine"`
+	VariantEngine string `toml:"variant_engine"`
+	// Downloads filters the games of every user, and UserDownloads
+	// overrides it for single users.
+	Downloads     DownloadFilter            `toml:"downloads"`
+	UserDownloads map[string]DownloadFilter `toml:"user_downloads"`
+	// Study is the ID of a lichess study analyzed games are added to, if any
+	Study string `toml:"study"`
+	// SkipServerAnalyzed keeps the evaluations of games analyzed on lichess
+	// instead of analyzing them again
+	SkipServerAnalyzed bool `toml:"skip_server_analyzed"`
+	// LastRun is the download cursor of a version 1 config, to be moved
+	// to the state file
+	LastRun int64 `toml:"-"`
+}
+
+// V1Keys are the keys of version 1 that have since moved, still read so
+// older configs keep working.
+type V1Keys struct {
+	Token    string   `toml:"token"`
+	Username []string `toml:"username"`
+	// LastRun was one download cursor shared by every user. Cursors are
+	// kept per user in the state file now.
+	LastRun int64 `toml:"last_run"`
 }
 
 func ReadConfig(configPath string) (*Config, error) {
-	configData, err := os.ReadFile(configPath)
+	configFile, err := os.Open(configPath)
 	if err != nil {
 		log.Printf("Error reading config file: %v\n", err)
 		return nil, err
 	}
+	defer configFile.Close()
 
-	var config Config
-	err = toml.Unmarshal(configData, &config)
+	var file struct {
+		Config
+		V1Keys
+	}
+	decoder := toml.NewDecoder(configFile)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&file)
 	if err != nil {
+		var strictErr *toml.StrictMissingError
+		var decodeErr *toml.DecodeError
+		switch {
+		case errors.As(err, &strictErr):
+			err = fmt.Errorf("Unknown keys in config %s:\n%s", configPath, strictErr.String())
+		case errors.As(err, &decodeErr):
+			err = fmt.Errorf("Invalid config %s:\n%s", configPath, decodeErr.String())
+		}
 		log.Printf("Error processing config: %v\n", err)
 		return nil, err
 	}
+	config := file.Config
+	err = config.migrate(file.V1Keys)
+	if err != nil {
+		log.Printf("Error processing config: %v\n", err)
+		return nil, err
+	}
+	if config.PAT != "" {
+		if info, err := configFile.Stat(); err == nil && info.Mode().Perm()&0077 != 0 {
+			log.Printf("%s holds a token and can be read by other users, run chmod 600 on it or use lichan login\n", configPath)
+		}
+	}
 
 	if len(config.Username) < 1 {
 		log.Println("No usernames provided")
@@ -50,14 +116,116 @@ func ReadConfig(configPath string) (*Config, error) {
 
 	config.GameDirectory = newPath
 
+	newPath, err = replaceTilde(config.EngineDirectory)
+	if err != nil {
+		log.Printf("Unable to clean path: %v\n", err)
+		return nil, err
+	}
+
+	config.EngineDirectory = newPath
+
+	err = config.Downloads.Validate()
+	if err != nil {
+		log.Printf("Invalid downloads filter: %v\n", err)
+		return nil, err
+	}
+	for user, filter := range config.UserDownloads {
+		err = filter.Validate()
+		if err != nil {
+			log.Printf("Invalid downloads filter for %s: %v\n", user, err)
+			return nil, err
+		}
+	}
+
+	config.APIURL, err = baseURL(config.APIURL, DefaultURL)
+	if err != nil {
+		log.Printf("Invalid api_url: %v\n", err)
+		return nil, err
+	}
+	config.SiteURL, err = baseURL(config.SiteURL, config.APIURL)
+	if err != nil {
+		log.Printf("Invalid site_url: %v\n", err)
+		return nil, err
+	}
+
+	if config.Engine == "" {
+		config.Engine = "stockfish"
+	}
+	if config.VariantEngine == "" {
+		config.VariantEngine = "fairy-stockfish"
+	}
+
 	return &config, nil
 }
 
+// DefaultURL is where lichess is found unless the config says otherwise
+const DefaultURL = "https://lichess.org"
+
+// baseURL checks a configured URL and drops its trailing slash, as paths
+// are appended to it. An unset URL is fallback.
+func baseURL(configured, fallback string) (string, error) {
+	if configured == "" {
+		return fallback, nil
+	}
+	u, err := url.Parse(configured)
+	if err != nil {
+		return "", err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("%q is not an http or https URL", configured)
+	}
+	return strings.TrimSuffix(configured, "/"), nil
+}
+
+// migrate reads a version 1 config into the current schema. A config
+// without a version is read with the keys of either version, as the README
+// asked for pat and usernames before there were versions.
+func (C *Config) migrate(v1 V1Keys) error {
+	hasV1 := v1.Token != "" || len(v1.Username) > 0 || v1.LastRun != 0
+	hasV2 := C.PAT != "" || len(C.Username) > 0
+	switch C.Version {
+	case 0:
+		if !hasV1 {
+			C.Version = SchemaVersion
+			log.Printf("Config has no version, set version = %d\n", SchemaVersion)
+			return nil
+		}
+		C.readV1(v1)
+	case 1:
+		if hasV2 {
+			return errors.New("pat and usernames are keys of config version 2, set version = 2 to use them")
+		}
+		C.readV1(v1)
+	case SchemaVersion:
+		if hasV1 {
+			return errors.New("token, username and last_run are keys of config version 1, use pat and usernames instead")
+		}
+	default:
+		return fmt.Errorf("Config version %d is not one this lichan reads (1 to %d)", C.Version, SchemaVersion)
+	}
+	return nil
+}
+
+// readV1 takes the keys of version 1, where the keys of version 2 are not
+// also given
+func (C *Config) readV1(v1 V1Keys) {
+	C.Version = 1
+	if C.PAT == "" {
+		C.PAT = v1.Token
+	}
+	if len(C.Username) == 0 {
+		C.Username = v1.Username
+	}
+	// The state file carries on from the cursor of the config
+	C.LastRun = v1.LastRun
+	log.Printf("Config version 1 is out of date: rename token to pat and username to usernames, remove last_run and set version = %d\n", SchemaVersion)
+}
+
 func replaceTilde(p string) (string, error) {
 	if !strings.HasPrefix(p, "~") {
 		return p, nil
 	}
-	
+
 	userHome, err := os.UserHomeDir()
 	if err != nil {
 		return p, err
@@ -69,16 +237,16 @@ func replaceTilde(p string) (string, error) {
 	return replacementPath, nil
 }
 
-func (C *Config) WriteConfig(configPath string) error {
-	configBytes, err := toml.Marshal(C)
-	if err != nil {
-		return err
-	}
-	err = os.WriteFile(configPath, configBytes, 0644)
-	if err != nil {
-		return err
+// DownloadFilter returns the filter for a user's games, matching usernames
+// case insensitively.
+func (C *Config) DownloadFilter(user string) DownloadFilter {
+	filter := C.Downloads
+	for name, userFilter := range C.UserDownloads {
+		if strings.EqualFold(name, user) {
+			filter = filter.Override(userFilter)
+		}
 	}
-	return nil
+	return filter
 }
 
 func (C *Config) CreateDirs() error {
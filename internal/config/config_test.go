@@ -0,0 +1,187 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func writeConfig(T *testing.T, contents string) string {
+	configPath := filepath.Join(T.TempDir(), "config.toml")
+	err := os.WriteFile(configPath, []byte("game_directory = \"/tmp/games\"\n"+contents+"\n"), 0600)
+	if err != nil {
+		T.Fatalf("Unable to write config: %v\n", err)
+	}
+	return configPath
+}
+
+func TestSelfHostedConfig(T *testing.T) {
+	tests := []struct {
+		Name    string
+		Config  string
+		APIURL  string
+		SiteURL string
+		Err     bool
+	}{
+		{
+			Name:    "defaults",
+			APIURL:  DefaultURL,
+			SiteURL: DefaultURL,
+		},
+		{
+			Name:    "site defaults to api",
+			Config:  `api_url = "http://localhost:9663/"`,
+			APIURL:  "http://localhost:9663",
+			SiteURL: "http://localhost:9663",
+		},
+		{
+			Name:    "both",
+			Config:  "api_url = \"http://lila:9663\"\nsite_url = \"https://chess.example.org/\"",
+			APIURL:  "http://lila:9663",
+			SiteURL: "https://chess.example.org",
+		},
+		{
+			Name:   "not a URL",
+			Config: `api_url = "lila:9663"`,
+			Err:    true,
+		},
+	}
+
+	for _, test := range tests {
+		c, err := ReadConfig(writeConfig(T, "version = 2\nusernames = [\"alice\"]\n"+test.Config))
+		if test.Err {
+			if err == nil {
+				T.Errorf("%s: expected an error\n", test.Name)
+			}
+			continue
+		}
+		if err != nil {
+			T.Errorf("%s: %v\n", test.Name, err)
+			continue
+		}
+		if c.APIURL != test.APIURL || c.SiteURL != test.SiteURL {
+			T.Errorf("%s: got %s and %s, expected %s and %s\n", test.Name, c.APIURL, c.SiteURL, test.APIURL, test.SiteURL)
+		}
+	}
+}
+
+func TestReadConfig(T *testing.T) {
+	tests := []struct {
+		Name     string
+		Config   string
+		Version  int
+		Username []string
+		PAT      string
+		LastRun  int64
+		Err      string
+	}{
+		{
+			Name:     "version 2",
+			Config:   "version = 2\nusernames = [\"alice\"]\npat = \"lip_x\"",
+			Version:  2,
+			Username: []string{"alice"},
+			PAT:      "lip_x",
+		},
+		{
+			Name:     "no version",
+			Config:   "username = [\"alice\"]\ntoken = \"lip_x\"\nlast_run = 1709647200000",
+			Version:  1,
+			Username: []string{"alice"},
+			PAT:      "lip_x",
+			LastRun:  1709647200000,
+		},
+		{
+			Name:     "version 1",
+			Config:   "version = 1\nusername = [\"alice\"]",
+			Version:  1,
+			Username: []string{"alice"},
+		},
+		{
+			Name:   "version 2 keys in version 1",
+			Config: "version = 1\nusernames = [\"alice\"]",
+			Err:    "set version = 2",
+		},
+		{
+			Name:     "version 2 keys without a version",
+			Config:   "usernames = [\"alice\"]\npat = \"lip_x\"",
+			Version:  2,
+			Username: []string{"alice"},
+			PAT:      "lip_x",
+		},
+		{
+			Name:     "keys of both versions without a version",
+			Config:   "usernames = [\"alice\"]\ntoken = \"lip_x\"\nlast_run = 1709647200000",
+			Version:  1,
+			Username: []string{"alice"},
+			PAT:      "lip_x",
+			LastRun:  1709647200000,
+		},
+		{
+			Name:   "version 1 keys in version 2",
+			Config: "version = 2\nusernames = [\"alice\"]\nlast_run = 1709647200000",
+			Err:    "keys of config version 1",
+		},
+		{
+			Name:   "unknown key",
+			Config: "version = 2\nusernames = [\"alice\"]\nengin = \"stockfish\"",
+			Err:    "engin",
+		},
+		{
+			Name:   "unknown filter key",
+			Config: "version = 2\nusernames = [\"alice\"]\n[downloads]\nperf = [\"blitz\"]",
+			Err:    "perf",
+		},
+		{
+			Name:   "newer version",
+			Config: "version = 3\nusernames = [\"alice\"]",
+			Err:    "not one this lichan reads",
+		},
+	}
+
+	for _, test := range tests {
+		c, err := ReadConfig(writeConfig(T, test.Config))
+		if test.Err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.Err) {
+				T.Errorf("%s: got error %v, expected one about %s\n", test.Name, err, test.Err)
+			}
+			continue
+		}
+		if err != nil {
+			T.Errorf("%s: %v\n", test.Name, err)
+			continue
+		}
+		if c.Version != test.Version || !slices.Equal(c.Username, test.Username) || c.PAT != test.PAT || c.LastRun != test.LastRun {
+			T.Errorf("%s: got %+v\n", test.Name, c)
+		}
+	}
+
+	// The sample config is what the README tells users to start from
+	c, err := ReadConfig(filepath.Join("..", "..", "sample_config.toml"))
+	if err != nil || c.Version != SchemaVersion || len(c.Username) == 0 {
+		T.Errorf("Sample config: %+v (%v)\n", c, err)
+	}
+}
+
+func TestSeedCursors(T *testing.T) {
+	cursors := Cursors{Users: map[string]map[string]int64{"bob": {"games": 1800000000000}}}
+	if !cursors.Seed([]string{"Alice", "bob"}, "games", 1700000000000) {
+		T.Fatalf("Cursors were not seeded\n")
+	}
+	if cursors.Get("alice", "games") != 1700000000000 || cursors.Get("bob", "games") != 1800000000000 {
+		T.Errorf("Seeded %+v\n", cursors.Users)
+	}
+
+	// A user resynced after the move starts from their first game
+	statePath := filepath.Join(T.TempDir(), "cursors.toml")
+	cursors.Reset("alice")
+	cursors.Write(statePath)
+	saved, err := ReadCursors(statePath)
+	if err != nil {
+		T.Fatalf("Unable to read cursors: %v\n", err)
+	}
+	if saved.Seed([]string{"alice", "bob"}, "games", 1700000000000) || saved.Get("alice", "games") != 0 {
+		T.Errorf("Cursors were seeded twice: %+v\n", saved.Users)
+	}
+}
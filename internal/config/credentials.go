@@ -0,0 +1,76 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// Credentials hold the token given by lichan login. They are kept apart
+// from the config, readable by the user alone, so the config can be shared.
+type Credentials struct {
+	Token  string   `toml:"token"`
+	Scopes []string `toml:"scopes"`
+	// Expires is when lichess stops accepting the token, in milliseconds
+	Expires int64 `toml:"expires,omitempty"`
+}
+
+// CredentialsPath is the file credentials are kept in, next to the config
+func CredentialsPath() (string, error) {
+	userConfigDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(userConfigDir, "lichan", "credentials.toml"), nil
+}
+
+// ReadCredentials reads the credentials saved at credentialsPath. There is
+// no token when there is no file.
+func ReadCredentials(credentialsPath string) (*Credentials, error) {
+	var credentials Credentials
+	credentialsData, err := os.ReadFile(credentialsPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &credentials, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = toml.Unmarshal(credentialsData, &credentials)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials, nil
+}
+
+// Expired reports whether lichess no longer accepts the token
+func (c *Credentials) Expired() bool {
+	return c.Expires > 0 && time.Now().UnixMilli() >= c.Expires
+}
+
+// Write saves the credentials readable by the user alone, through a
+// temporary file so an interrupted write never loses them.
+func (c *Credentials) Write(credentialsPath string) error {
+	credentialsBytes, err := toml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(credentialsPath), 0700)
+	if err != nil {
+		return err
+	}
+	partPath := credentialsPath + ".part"
+	err = os.WriteFile(partPath, credentialsBytes, 0600)
+	if err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of a part file left over from before
+	err = os.Chmod(partPath, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(partPath, credentialsPath)
+}
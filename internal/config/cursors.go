@@ -0,0 +1,111 @@
+package config
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	toml "github.com/pelletier/go-toml/v2"
+)
+
+// Cursors records how far the games of each user have been downloaded from
+// each source, as the creation time of the last game saved in milliseconds.
+type Cursors struct {
+	Users map[string]map[string]int64 `toml:"users"`
+	// LastRun is the cursor of a version 1 config once it has been moved
+	// here, so it is only moved once
+	LastRun int64 `toml:"last_run,omitempty"`
+}
+
+// StatePath is the file cursors are kept in, under $XDG_STATE_HOME or
+// ~/.local/state.
+func StatePath() (string, error) {
+	stateDir := os.Getenv("XDG_STATE_HOME")
+	if stateDir == "" {
+		userHome, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateDir = path.Join(userHome, ".local", "state")
+	}
+	return path.Join(stateDir, "lichan", "cursors.toml"), nil
+}
+
+// ReadCursors reads the cursors saved at statePath. Nothing has been
+// downloaded yet when there is no file.
+func ReadCursors(statePath string) (*Cursors, error) {
+	cursors := Cursors{Users: make(map[string]map[string]int64)}
+	stateData, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &cursors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = toml.Unmarshal(stateData, &cursors)
+	if err != nil {
+		return nil, err
+	}
+	if cursors.Users == nil {
+		cursors.Users = make(map[string]map[string]int64)
+	}
+	return &cursors, nil
+}
+
+// Get returns the time of the last game saved, or zero to start from the
+// first game. Usernames are matched case insensitively, like on lichess.
+func (c *Cursors) Get(user, source string) int64 {
+	return c.Users[strings.ToLower(user)][source]
+}
+
+func (c *Cursors) Set(user, source string, lastGameTime int64) {
+	user = strings.ToLower(user)
+	if c.Users[user] == nil {
+		c.Users[user] = make(map[string]int64)
+	}
+	c.Users[user][source] = lastGameTime
+}
+
+// Seed starts the users without a cursor for source from lastRun, the
+// cursor a version 1 config shared between users. It reports whether the
+// cursors changed; a lastRun seeded before is not seeded again, so a user
+// resynced since starts from their first game.
+func (c *Cursors) Seed(users []string, source string, lastRun int64) bool {
+	if lastRun == 0 || lastRun == c.LastRun {
+		return false
+	}
+	for _, user := range users {
+		if c.Get(user, source) == 0 {
+			c.Set(user, source, lastRun)
+		}
+	}
+	c.LastRun = lastRun
+	return true
+}
+
+// Reset forgets every source of the user, so their whole history is
+// downloaded again.
+func (c *Cursors) Reset(user string) {
+	delete(c.Users, strings.ToLower(user))
+}
+
+// Write saves the cursors through a temporary file, so an interrupted write
+// never loses them.
+func (c *Cursors) Write(statePath string) error {
+	stateBytes, err := toml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(path.Dir(statePath), 0755)
+	if err != nil {
+		return err
+	}
+	partPath := statePath + ".part"
+	err = os.WriteFile(partPath, stateBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(partPath, statePath)
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// DownloadFilter selects the games downloaded for a user. The fields map to
+// the parameters of the lichess game export; unset fields leave the lichess
+// default.
+type DownloadFilter struct {
+	PerfType []string `toml:"perf_type,omitempty"`
+	Rated    *bool    `toml:"rated,omitempty"`
+	// Color is the side the user played, white or black
+	Color string `toml:"color,omitempty"`
+	// Vs only downloads games against this opponent
+	Vs string `toml:"vs,omitempty"`
+	// Max is the most games downloaded in one run
+	Max int `toml:"max,omitempty"`
+	// Since and Until are dates as YYYY-MM-DD, or times in milliseconds
+	Since    string `toml:"since,omitempty"`
+	Until    string `toml:"until,omitempty"`
+	Analysed *bool  `toml:"analysed,omitempty"`
+	Ongoing  *bool  `toml:"ongoing,omitempty"`
+	Finished *bool  `toml:"finished,omitempty"`
+}
+
+var perfTypes = []string{
+	"ultraBullet", "bullet", "blitz", "rapid", "classical", "correspondence",
+	"chess960", "crazyhouse", "antichess", "atomic", "horde", "kingOfTheHill",
+	"racingKings", "threeCheck",
+}
+
+// Override returns the filter with every field set in o replacing its own
+func (f DownloadFilter) Override(o DownloadFilter) DownloadFilter {
+	if len(o.PerfType) > 0 {
+		f.PerfType = o.PerfType
+	}
+	if o.Rated != nil {
+		f.Rated = o.Rated
+	}
+	if o.Color != "" {
+		f.Color = o.Color
+	}
+	if o.Vs != "" {
+		f.Vs = o.Vs
+	}
+	if o.Max > 0 {
+		f.Max = o.Max
+	}
+	if o.Since != "" {
+		f.Since = o.Since
+	}
+	if o.Until != "" {
+		f.Until = o.Until
+	}
+	if o.Analysed != nil {
+		f.Analysed = o.Analysed
+	}
+	if o.Ongoing != nil {
+		f.Ongoing = o.Ongoing
+	}
+	if o.Finished != nil {
+		f.Finished = o.Finished
+	}
+	return f
+}
+
+func (f DownloadFilter) Validate() error {
+	for _, perfType := range f.PerfType {
+		if !slices.Contains(perfTypes, perfType) {
+			return fmt.Errorf("Unknown perf_type %q, expected one of %v", perfType, perfTypes)
+		}
+	}
+	if f.Color != "" && f.Color != "white" && f.Color != "black" {
+		return fmt.Errorf("Unknown color %q, expected white or black", f.Color)
+	}
+	if f.Max < 0 {
+		return fmt.Errorf("max must not be negative")
+	}
+	if _, err := ParseDownloadTime(f.Since); err != nil {
+		return fmt.Errorf("since: %w", err)
+	}
+	if _, err := ParseDownloadTime(f.Until); err != nil {
+		return fmt.Errorf("until: %w", err)
+	}
+	return nil
+}
+
+// ParseDownloadTime reads a date as YYYY-MM-DD in UTC, or a time in
+// milliseconds, as milliseconds. An empty time is zero.
+func ParseDownloadTime(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if millis, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return millis, nil
+	}
+	date, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		return 0, fmt.Errorf("%q is neither a YYYY-MM-DD date nor a time in milliseconds", value)
+	}
+	return date.UnixMilli(), nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("Unauthorized: check the lichess token")
+	ErrForbidden    = errors.New("Forbidden: the token lacks a required scope")
+	ErrNotFound     = errors.New("Not found")
+	ErrRateLimited  = errors.New("Rate limited by lichess")
+	ErrServer       = errors.New("Lichess server error")
+)
+
+// APIError is a response from lichess with an unsuccessful status. It
+// unwraps to one of the errors above where the status has one.
+type APIError struct {
+	StatusCode int
+	Method     string
+	URL        string
+	// Message is the error lichess gave in the body, if any
+	Message string
+	// RetryAfter is how long lichess asked to wait before trying again
+	RetryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s %s: %d %s: %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+	}
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+func (e *APIError) Unwrap() error {
+	switch {
+	case e.StatusCode == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case e.StatusCode == http.StatusForbidden:
+		return ErrForbidden
+	case e.StatusCode == http.StatusNotFound:
+		return ErrNotFound
+	case e.StatusCode == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case e.StatusCode >= 500:
+		return ErrServer
+	}
+	return nil
+}
+
+// LichessClient makes requests to the lichess API, waiting out rate limits
+// and retrying requests that fail for transient reasons.
+type LichessClient struct {
+	BaseURL string
+	Token   string
+	HTTP    *http.Client
+	// MaxRetries is how many times a failed request is tried again
+	MaxRetries int
+	// RateLimitWait is how long to wait after a 429. Lichess asks clients
+	// to wait a full minute.
+	RateLimitWait time.Duration
+	// RetryWait is the wait before the first retry of a transient error.
+	// It doubles with each retry, with up to as much again added at random.
+	RetryWait time.Duration
+	// IdleTimeout cancels a response body that sends nothing for this long
+	IdleTimeout time.Duration
+	sleep       func(context.Context, time.Duration) error
+}
+
+func NewLichessClient(baseURL, token string) *LichessClient {
+	return &LichessClient{
+		BaseURL: baseURL,
+		Token:   token,
+		HTTP: &http.Client{
+			// Game exports stream for as long as there are games, so only
+			// the connection and the wait for a response are timed here,
+			// and the body by IdleTimeout.
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		MaxRetries:    3,
+		RateLimitWait: time.Minute,
+		RetryWait:     time.Second,
+		IdleTimeout:   time.Minute,
+		sleep:         sleepContext,
+	}
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// NewRequest builds a request for an API path such as /api/account
+func (c *LichessClient) NewRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (req *http.Request, err error) {
+	reqUrl := c.BaseURL + path
+	if len(query) > 0 {
+		reqUrl += "?" + query.Encode()
+	}
+	req, err = http.NewRequestWithContext(ctx, method, reqUrl, body)
+	if err != nil {
+		return
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", c.Token))
+	}
+	return
+}
+
+// Do sends the request and returns the response when its status is
+// successful. Otherwise the error is an *APIError, or the error of the last
+// attempt when lichess could not be reached. The caller closes the body.
+func (c *LichessClient) Do(req *http.Request) (res *http.Response, err error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	defer func() {
+		if res == nil {
+			cancel()
+		}
+	}()
+	req = req.WithContext(ctx)
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 && req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return
+			}
+		}
+
+		res, err = c.HTTP.Do(req)
+		var wait time.Duration
+		switch {
+		case err != nil:
+			if req.Context().Err() != nil {
+				return
+			}
+			wait = c.backoff(attempt)
+		case res.StatusCode >= 200 && res.StatusCode < 300:
+			res.Body = newIdleBody(res.Body, c.IdleTimeout, cancel)
+			return
+		default:
+			apiErr := readAPIError(req, res)
+			res, err = nil, apiErr
+			switch {
+			case errors.Is(err, ErrRateLimited):
+				wait = max(c.RateLimitWait, apiErr.RetryAfter)
+			case errors.Is(err, ErrServer):
+				wait = c.backoff(attempt)
+			default:
+				// The request itself is at fault, so trying again won't help
+				return
+			}
+		}
+
+		if attempt >= c.MaxRetries {
+			return
+		}
+		log.Printf("%s %s failed, retrying in %s: %v\n", req.Method, req.URL.Path, wait.Round(time.Second), err)
+		if sleepErr := c.sleep(req.Context(), wait); sleepErr != nil {
+			return
+		}
+	}
+}
+
+// idleBody cancels the request of a response that sends nothing for
+// longer than timeout, as a stalled export would otherwise block forever.
+type idleBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	expired atomic.Bool
+	cancel  context.CancelFunc
+}
+
+func newIdleBody(body io.ReadCloser, timeout time.Duration, cancel context.CancelFunc) *idleBody {
+	b := &idleBody{ReadCloser: body, timeout: timeout, cancel: cancel}
+	if timeout > 0 {
+		b.timer = time.AfterFunc(timeout, func() {
+			b.expired.Store(true)
+			cancel()
+		})
+	}
+	return b
+}
+
+func (b *idleBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if b.timer == nil {
+		return
+	}
+	if err != nil && b.expired.Load() {
+		err = fmt.Errorf("No data from lichess for %s: %w", b.timeout, err)
+		return
+	}
+	b.timer.Reset(b.timeout)
+	return
+}
+
+func (b *idleBody) Close() error {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// readAPIError closes the body of an unsuccessful response and describes it
+func readAPIError(req *http.Request, res *http.Response) *APIError {
+	defer res.Body.Close()
+	apiErr := &APIError{StatusCode: res.StatusCode, Method: req.Method, URL: req.URL.Redacted()}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		apiErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	var message struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &message) == nil {
+		apiErr.Message = message.Error
+	}
+	return apiErr
+}
+
+func (c *LichessClient) backoff(attempt int) time.Duration {
+	wait := c.RetryWait << attempt
+	if wait <= 0 {
+		return 0
+	}
+	return wait + rand.N(wait)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/theMagicRabbit/lichan/internal/config"
+)
+
+func TestLichessClient(T *testing.T) {
+	tests := []struct {
+		Name string
+		// Responses are the statuses the server answers with in turn
+		Responses  []int
+		RetryAfter string
+		Expected   error
+		Requests   int
+		Waits      []time.Duration
+	}{
+		{Name: "success", Responses: []int{200}, Requests: 1},
+		{Name: "rate limited", Responses: []int{429, 200}, Requests: 2, Waits: []time.Duration{time.Minute}},
+		{Name: "longer retry after", Responses: []int{429, 200}, RetryAfter: "90", Requests: 2, Waits: []time.Duration{90 * time.Second}},
+		{Name: "server error", Responses: []int{503, 502, 200}, Requests: 3, Waits: []time.Duration{time.Second, 2 * time.Second}},
+		{Name: "retries run out", Responses: []int{500, 500, 500, 500}, Expected: ErrServer, Requests: 4, Waits: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}},
+		{Name: "unauthorized", Responses: []int{401}, Expected: ErrUnauthorized, Requests: 1},
+		{Name: "not found", Responses: []int{404}, Expected: ErrNotFound, Requests: 1},
+	}
+
+	for _, test := range tests {
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				T.Errorf("%s: request sent without the token\n", test.Name)
+			}
+			status := test.Responses[min(requests, len(test.Responses)-1)]
+			requests++
+			if test.RetryAfter != "" {
+				w.Header().Set("Retry-After", test.RetryAfter)
+			}
+			w.WriteHeader(status)
+			if status != 200 {
+				w.Write([]byte(`{"error":"Something went wrong"}`))
+			}
+		}))
+
+		client := NewLichessClient(server.URL, "secret")
+		var waits []time.Duration
+		client.sleep = func(ctx context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		}
+
+		req, err := client.NewRequest(context.Background(), http.MethodGet, "/api/account", nil, nil)
+		if err != nil {
+			T.Fatalf("%s: %s\n", test.Name, err.Error())
+		}
+		res, err := client.Do(req)
+		if res != nil {
+			res.Body.Close()
+		}
+		server.Close()
+
+		if !errors.Is(err, test.Expected) {
+			T.Errorf("%s: error %v, expected %v\n", test.Name, err, test.Expected)
+		}
+		var apiErr *APIError
+		if test.Expected != nil && (!errors.As(err, &apiErr) || apiErr.Message != "Something went wrong") {
+			T.Errorf("%s: error %v does not carry the lichess message\n", test.Name, err)
+		}
+		if requests != test.Requests {
+			T.Errorf("%s: sent %d requests, expected %d\n", test.Name, requests, test.Requests)
+		}
+		// Retries after transient errors wait up to twice as long at random
+		if !slices.EqualFunc(waits, test.Waits, func(wait, expected time.Duration) bool {
+			if expected >= client.RateLimitWait {
+				return wait == expected
+			}
+			return wait >= expected && wait < 2*expected
+		}) {
+			T.Errorf("%s: waited %v, expected %v\n", test.Name, waits, test.Waits)
+		}
+	}
+}
+
+func TestLichessIdleTimeout(T *testing.T) {
+	// The export stalls after its first game until the client gives up
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"id":"aaaaaaaa"}` + "\n"))
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	client := NewLichessClient(server.URL, "secret")
+	client.IdleTimeout = 100 * time.Millisecond
+	req, err := client.NewRequest(context.Background(), http.MethodGet, "/api/games/user/alice", nil, nil)
+	if err != nil {
+		T.Fatal(err)
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		T.Fatalf("Unexpected error: %v\n", err)
+	}
+	defer res.Body.Close()
+
+	done := make(chan struct{})
+	var body []byte
+	go func() {
+		body, err = io.ReadAll(res.Body)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		T.Fatalf("Reading a stalled export did not time out\n")
+	}
+	if err == nil || !strings.Contains(err.Error(), "No data from lichess") {
+		T.Errorf("Got error %v, expected the idle timeout\n", err)
+	}
+	if string(body) != `{"id":"aaaaaaaa"}`+"\n" {
+		T.Errorf("Read %q before the timeout\n", body)
+	}
+}
+
+func TestDownloadSavesEachGame(T *testing.T) {
+	games := []string{
+		`{"id":"aaaaaaaa","createdAt":1709647200000,"players":{"white":{"user":{"name":"alice"}},"black":{"user":{"name":"bob"}}},"moves":"e4 e5"}`,
+		`{"id":"bbbbbbbb","createdAt":1709650800000,"players":{"white":{"user":{"name":"bob"}},"black":{"user":{"name":"alice"}}},"moves":"d4 d5"}`,
+	}
+	var since []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since = append(since, r.URL.Query().Get("since"))
+		for _, game := range games {
+			w.Write([]byte(game + "\n"))
+		}
+		// Drop the connection part way through the third game
+		w.Write([]byte(`{"id":"cccccccc","createdAt":17096`))
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler)
+	}))
+	defer server.Close()
+
+	dir := T.TempDir()
+	s := state{
+		Config:    &config.Config{GameDirectory: dir, Username: []string{"alice", "bob"}},
+		Lichess:   NewLichessClient(server.URL, "secret"),
+		Cursors:   &config.Cursors{Users: map[string]map[string]int64{"bob": {gamesSource: 1600000000000}}},
+		StatePath: filepath.Join(dir, "state", "cursors.toml"),
+	}
+	s.Config.CreateDirs()
+
+	err := s.handlerDownloads("alice")
+	if err == nil {
+		T.Errorf("Expected the broken stream to be reported\n")
+	}
+	archived, err := readArchive(archivePath(filepath.Join(dir, "alice")))
+	if err != nil || len(archived) != 2 {
+		T.Fatalf("Archived %d games (%v), expected 2\n", len(archived), err)
+	}
+	for _, game := range archived {
+		if _, err := os.Stat(filepath.Join(dir, "alice", game.pgnFileName())); err != nil {
+			T.Errorf("PGN of %s was not written: %v\n", game.ID, err)
+		}
+	}
+	saved, err := config.ReadCursors(s.StatePath)
+	if err != nil || saved.Get("Alice", gamesSource) != 1709650800000 || saved.Get("bob", gamesSource) != 1600000000000 {
+		T.Errorf("Checkpoint %+v (%v) does not hold the last saved game of each user\n", saved, err)
+	}
+
+	// The next run starts after the last saved game, and a resync from the
+	// first game without saving any game twice
+	s.handlerDownloads("alice")
+	s.handlerDownloads("bob")
+	if err := s.handlerResync([]string{"ALICE"}); err == nil {
+		T.Errorf("Expected the broken stream to be reported\n")
+	}
+	if !slices.Equal(since, []string{"", "1709650800001", "1600000000001", ""}) {
+		T.Errorf("Requested since %v\n", since)
+	}
+	archived, _ = readArchive(archivePath(filepath.Join(dir, "alice")))
+	if len(archived) != 2 {
+		T.Errorf("Archived %d games after resync, expected 2\n", len(archived))
+	}
+	if err := s.handlerResync([]string{"carol"}); err == nil {
+		T.Errorf("Expected resync of an unknown user to fail\n")
+	}
+}
+
+func TestDownloadQuery(T *testing.T) {
+	yes := true
+	cfg := config.Config{
+		Downloads: config.DownloadFilter{PerfType: []string{"blitz", "rapid", "classical"}, Finished: &yes},
+		UserDownloads: map[string]config.DownloadFilter{
+			"Alice": {Rated: &yes, PerfType: []string{"classical"}, Since: "2024-01-01"},
+		},
+	}
+	tests := []struct {
+		Name         string
+		User         string
+		Args         []string
+		LastGameTime int64
+		Expected     string
+	}{
+		{
+			Name:     "defaults",
+			User:     "bob",
+			Expected: "accuracy=true&clocks=true&evals=true&finished=true&opening=true&perfType=blitz%2Crapid%2Cclassical&sort=dateAsc",
+		},
+		{
+			Name:     "user filter",
+			User:     "alice",
+			Expected: "accuracy=true&clocks=true&evals=true&finished=true&opening=true&perfType=classical&rated=true&since=1704067200000&sort=dateAsc",
+		},
+		{
+			Name:         "cursor after since",
+			User:         "alice",
+			LastGameTime: 1709647200000,
+			Expected:     "accuracy=true&clocks=true&evals=true&finished=true&opening=true&perfType=classical&rated=true&since=1709647200001&sort=dateAsc",
+		},
+		{
+			Name:     "command line",
+			User:     "alice",
+			Args:     []string{"-rated=false", "-color", "black", "-vs", "carol", "-max", "50", "-until", "1709647200000", "-ongoing"},
+			Expected: "accuracy=true&clocks=true&color=black&evals=true&finished=true&max=50&ongoing=true&opening=true&perfType=classical&rated=false&since=1704067200000&sort=dateAsc&until=1709647200000&vs=carol",
+		},
+	}
+
+	for _, test := range tests {
+		var override config.DownloadFilter
+		if err := downloadFlags("sync", &override).Parse(test.Args); err != nil {
+			T.Fatalf("%s: %s\n", test.Name, err.Error())
+		}
+		opts, err := downloadQuery(cfg.DownloadFilter(test.User).Override(override), test.LastGameTime)
+		if err != nil {
+			T.Errorf("%s: unexpected error: %s\n", test.Name, err.Error())
+			continue
+		}
+		if query := opts.Encode(); query != test.Expected {
+			T.Errorf("%s: query\n%s\ndoes not match expected\n%s\n", test.Name, query, test.Expected)
+		}
+	}
+
+	var override config.DownloadFilter
+	flags := downloadFlags("sync", &override)
+	flags.SetOutput(io.Discard)
+	for _, args := range [][]string{{"-perf-type", "blitz,lightning"}, {"-color", "red"}, {"-since", "yesterday"}} {
+		if err := flags.Parse(args); err == nil {
+			T.Errorf("Expected %v to be rejected\n", args)
+		}
+	}
+}
+
+func TestSourceID(T *testing.T) {
+	tests := []struct {
+		Source string
+		Ref    string
+		ID     string
+		Err    bool
+	}{
+		{Source: "ids", Ref: "aaaaaaaa", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "aaaaaaaaWxYz", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "https://lichess.org/aaaaaaaa", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "https://lichess.org/aaaaaaaa/black", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "https://lichess.org/aaaaaaaaWxYz", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "https://lichess.org/aaaaaaaa/white#12", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "lichess.org/aaaaaaaa", ID: "aaaaaaaa"},
+		{Source: "ids", Ref: "https://lichess.org/", Err: true},
+		{Source: "tournament", Ref: "spring24", ID: "spring24"},
+		{Source: "tournament", Ref: "https://lichess.org/tournament/spring24", ID: "spring24"},
+		{Source: "swiss", Ref: "https://lichess.org/swiss/Q3xYz0Ab/", ID: "Q3xYz0Ab"},
+		{Source: "study", Ref: "AbCdEfGh", ID: "AbCdEfGh"},
+		{Source: "study", Ref: "https://lichess.org/study/AbCdEfGh", ID: "AbCdEfGh"},
+		{Source: "study", Ref: "https://lichess.org/study/AbCdEfGh/IjKlMnOp", ID: "AbCdEfGh"},
+		{Source: "study", Ref: "https://lichess.org/api/study/AbCdEfGh.pgn", ID: "AbCdEfGh"},
+		{Source: "broadcast", Ref: "RoUnD123", ID: "RoUnD123"},
+		{Source: "broadcast", Ref: "https://lichess.org/broadcast/club-championship/round-1/RoUnD123", ID: "RoUnD123"},
+		{Source: "broadcast", Ref: "https://lichess.org/broadcast/club-championship/round-1/RoUnD123/GaMe4567", ID: "RoUnD123"},
+		{Source: "broadcast", Ref: "https://lichess.org/api/broadcast/round/RoUnD123.pgn", ID: "RoUnD123"},
+		{Source: "broadcast", Ref: "https://lichess.org/broadcast/club-championship/ToUr1234", Err: true},
+	}
+
+	for _, test := range tests {
+		id, err := sourceID(test.Source, test.Ref)
+		if (err != nil) != test.Err || id != test.ID {
+			T.Errorf("%s %s: got %q (%v), expected %q\n", test.Source, test.Ref, id, err, test.ID)
+		}
+	}
+}
+
+func TestFetch(T *testing.T) {
+	game := func(id string) string {
+		return `{"id":"` + id + `","createdAt":1709647200000,"status":"resign","players":{"white":{"user":{"name":"alice"}},"black":{"user":{"name":"bob"}}},"moves":"e4 e5"}` + "\n"
+	}
+	study := "[Event \"Club study: Round 1\"]\n\n1. e4 e5 *\n"
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+string(body))
+		switch r.URL.Path {
+		case "/api/games/export/_ids":
+			for _, id := range strings.Split(string(body), ",") {
+				w.Write([]byte(game(id)))
+			}
+		case "/api/tournament/spring24/games":
+			w.Write([]byte(game("cccccccc") + game("dddddddd")))
+		case "/api/study/AbCdEfGh.pgn":
+			w.Write([]byte(study))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := T.TempDir()
+	s := state{
+		Config:  &config.Config{GameDirectory: filepath.Join(dir, "games"), EngineDirectory: filepath.Join(dir, "engine")},
+		Lichess: NewLichessClient(server.URL, "secret"),
+	}
+
+	err := s.fetch("ids", []string{"https://lichess.org/aaaaaaaa", "bbbbbbbbWxYz,aaaaaaaa"}, "games")
+	if err != nil {
+		T.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	err = s.fetch("tournament", []string{"https://lichess.org/tournament/spring24"}, "tournament_spring24")
+	if err != nil {
+		T.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	err = s.fetch("study", []string{"AbCdEfGh"}, "study_AbCdEfGh")
+	if err != nil {
+		T.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	if err := s.fetch("swiss", []string{"missing"}, "swiss_missing"); !errors.Is(err, ErrNotFound) {
+		T.Errorf("Error %v, expected not found\n", err)
+	}
+
+	expected := []string{
+		"POST /api/games/export/_ids aaaaaaaa,bbbbbbbb",
+		"GET /api/tournament/spring24/games ",
+		"GET /api/study/AbCdEfGh.pgn ",
+		"GET /api/swiss/missing/games ",
+	}
+	if !slices.Equal(requests, expected) {
+		T.Errorf("Requests %q do not match expected %q\n", requests, expected)
+	}
+	for folder, count := range map[string]int{"games": 2, "tournament_spring24": 2} {
+		archived, _ := readArchive(archivePath(filepath.Join(dir, "games", folder)))
+		if len(archived) != count {
+			T.Errorf("%s holds %d games, expected %d\n", folder, len(archived), count)
+		}
+	}
+
+	// Fetching a study again replaces the analysis of its old chapters
+	enginePath := filepath.Join(dir, "engine", "study_AbCdEfGh", "study_abcdefgh_stockfish.pgn")
+	os.MkdirAll(filepath.Dir(enginePath), 0755)
+	os.WriteFile(enginePath, []byte(study), 0644)
+	study += "\n[Event \"Club study: Round 2\"]\n\n1. d4 d5 *\n"
+	s.fetch("study", []string{"AbCdEfGh"}, "study_AbCdEfGh")
+	saved, _ := os.ReadFile(filepath.Join(dir, "games", "study_AbCdEfGh", "study_AbCdEfGh.pgn"))
+	if string(saved) != study {
+		T.Errorf("Study was not updated:\n%s\n", saved)
+	}
+	if _, err := os.Stat(enginePath); !errors.Is(err, os.ErrNotExist) {
+		T.Errorf("Analysis of the old study was kept\n")
+	}
+}
+
+func TestPushToStudy(T *testing.T) {
+	analyzed := `[Event "rated blitz game"]
+[White "alice"]
+[Black "bob"]
+[Result "1-0"]
+[GameId "aaaaaaaa"]
+[UTCDate "2024.03.05"]
+
+1. e4 { [%eval 0.30] } 1... e5 1-0
+
+[Event "rated blitz game"]
+[White "carol"]
+[Black "alice"]
+[Result "0-1"]
+[GameId "bbbbbbbb"]
+[UTCDate "2024.03.06"]
+[Variant "Crazyhouse"]
+
+1. d4 d5 0-1
+`
+	// The stand-in study already holds the first game
+	chapters := []string{"alice - bob, 2024.03.05 (aaaaaaaa)"}
+	var imports []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/study/StUdY123.pgn":
+			for _, chapter := range chapters {
+				fmt.Fprintf(w, "[Event \"Club games: %s\"]\n[StudyName \"Club games\"]\n[ChapterName \"%s\"]\n\n*\n\n", chapter, chapter)
+			}
+		case r.Method == http.MethodPost && r.URL.Path == "/api/study/StUdY123/import-pgn":
+			r.ParseForm()
+			imports = append(imports, r.PostForm)
+			chapters = append(chapters, r.PostForm.Get("name"))
+			w.Write([]byte(`{"chapters":[]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	dir := T.TempDir()
+	s := state{
+		Config:  &config.Config{EngineDirectory: dir, Study: "StUdY123"},
+		Lichess: NewLichessClient(server.URL, "secret"),
+	}
+	os.MkdirAll(filepath.Join(dir, "alice"), 0755)
+	os.WriteFile(filepath.Join(dir, "alice", "games_stockfish.pgn"), []byte(analyzed), 0644)
+
+	for range 2 {
+		if err := s.handlerPush([]string{"alice"}); err != nil {
+			T.Fatalf("Unexpected error: %s\n", err.Error())
+		}
+	}
+	if len(imports) != 1 {
+		T.Fatalf("Imported %d chapters, expected 1\n", len(imports))
+	}
+	form := imports[0]
+	if form.Get("name") != "carol - alice, 2024.03.06 (bbbbbbbb)" || form.Get("orientation") != "black" || form.Get("variant") != "crazyhouse" {
+		T.Errorf("Import %v does not match expected\n", form)
+	}
+	if !strings.Contains(form.Get("pgn"), "1. d4 d5 0-1") {
+		T.Errorf("Imported PGN does not hold the game:\n%s\n", form.Get("pgn"))
+	}
+
+	s.Config.Study = "missing"
+	if err := s.handlerPush([]string{"alice"}); !errors.Is(err, ErrNotFound) {
+		T.Errorf("Error %v, expected not found\n", err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"os"
 	"path"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/theMagicRabbit/lichan/internal/config"
 )
@@ -12,6 +16,14 @@ type state struct {
 	Config  *config.Config
 	ApiUrl  string
 	SiteUrl string
+	Lichess *LichessClient
+	// Cursors are saved to StatePath as games are downloaded
+	Cursors   *config.Cursors
+	StatePath string
+	// Filter is given on the command line and overrides the config
+	Filter config.DownloadFilter
+	// CredentialsPath holds the token of lichan login
+	CredentialsPath string
 }
 
 func main() {
@@ -20,25 +32,160 @@ func main() {
 		log.Fatalf("Could not locate user config directory: %v\n", err)
 	}
 
+	statePath, err := config.StatePath()
+	if err != nil {
+		log.Fatalf("Could not locate state directory: %v\n", err)
+	}
+	cursors, err := config.ReadCursors(statePath)
+	if err != nil {
+		log.Fatalf("Error reading download state: %v\n", err)
+	}
+
+	credentialsPath, err := config.CredentialsPath()
+	if err != nil {
+		log.Fatalf("Could not locate credentials: %v\n", err)
+	}
+	credentials, err := config.ReadCredentials(credentialsPath)
+	if err != nil {
+		log.Fatalf("Error reading credentials: %v\n", err)
+	}
+
 	configFile := path.Join(userConfigDir, "lichan", "config.toml")
 	config, err := config.ReadConfig(configFile)
 	if err != nil {
 		log.Fatalf("Error reading config: %v\n", err)
 	}
-	defer config.WriteConfig(configFile)
 
 	state := state{
-		Config:  config,
-		ApiUrl:  "https://lichess.org",
-		SiteUrl: "https://lichess.org",
+		Config:          config,
+		ApiUrl:          config.APIURL,
+		SiteUrl:         config.SiteURL,
+		Cursors:         cursors,
+		StatePath:       statePath,
+		CredentialsPath: credentialsPath,
+	}
+
+	if state.Cursors.Seed(config.Username, gamesSource, config.LastRun) {
+		log.Printf("Download cursor of the config moved to %s\n", statePath)
+		err = state.checkpoint()
+		if err != nil {
+			log.Fatalf("Error writing download state: %v\n", err)
+		}
+	}
+
+	command, args := "sync", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
 	}
 
-	err = state.Config.CreateDirs()
+	// A login replaces the token of the config until it expires
+	token := config.PAT
+	switch {
+	case credentials.Token != "" && !credentials.Expired():
+		token = credentials.Token
+	case credentials.Token != "" && config.PAT != "":
+		log.Println("The lichess login has expired, using the pat of the config")
+	case credentials.Token != "" && !slices.Contains([]string{"login", "logout", "validate", "import"}, command):
+		log.Fatalln("The lichess login has expired, run lichan login")
+	}
+	state.Lichess = NewLichessClient(state.ApiUrl, token)
+	switch command {
+	case "sync":
+		flags := downloadFlags("sync", &state.Filter)
+		err = flags.Parse(args)
+		if err == nil {
+			err = state.handlerSync(state.Config.Username)
+		}
+	case "resync":
+		flags := downloadFlags("resync", &state.Filter)
+		err = flags.Parse(args)
+		if err == nil {
+			users := flags.Args()
+			if len(users) == 0 {
+				users = state.Config.Username
+			}
+			err = state.handlerResync(users)
+		}
+	case "validate":
+		problems, err := state.handlerValidate()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if problems > 0 {
+			log.Printf("Found %d problems\n", problems)
+			os.Exit(1)
+		}
+		return
+	case "import":
+		err = state.handlerImport(args)
+	case "fetch":
+		err = state.handlerFetch(args)
+	case "login":
+		err = state.handlerLogin()
+	case "logout":
+		err = state.handlerLogout()
+	case "push":
+		folders := args
+		if len(folders) == 0 {
+			folders = state.Config.Username
+		}
+		err = state.handlerPush(folders)
+	default:
+		log.Fatalf("Unknown command %q. Usage: lichan [sync|resync [user...]|fetch|push [folder...]|validate|import|login|logout] [flags]\n", command)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	for _, user := range state.Config.Username {
-		state.handlerDownloads(user)
-		state.handlerAnalyze(user)
+}
+
+// downloadFlags reads a download filter from the command line. Flags that
+// are left out keep the filters of the config.
+func downloadFlags(name string, filter *config.DownloadFilter) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Func("perf-type", "comma separated game types, e.g. blitz,rapid", func(value string) error {
+		filter.PerfType = splitList(value)
+		return filter.Validate()
+	})
+	flags.Var(optionalBool{&filter.Rated}, "rated", "only rated games, or with =false only casual games")
+	flags.Func("color", "only games played as white or black", func(value string) error {
+		filter.Color = value
+		return filter.Validate()
+	})
+	flags.StringVar(&filter.Vs, "vs", "", "only games against this opponent")
+	flags.IntVar(&filter.Max, "max", 0, "the most games to download")
+	flags.Func("since", "games played from this date (YYYY-MM-DD) or time in milliseconds", func(value string) error {
+		filter.Since = value
+		return filter.Validate()
+	})
+	flags.Func("until", "games played before this date (YYYY-MM-DD) or time in milliseconds", func(value string) error {
+		filter.Until = value
+		return filter.Validate()
+	})
+	flags.Var(optionalBool{&filter.Analysed}, "analysed", "only games analysed on lichess")
+	flags.Var(optionalBool{&filter.Ongoing}, "ongoing", "include games in progress")
+	flags.Var(optionalBool{&filter.Finished}, "finished", "include finished games")
+	return flags
+}
+
+// optionalBool is a boolean flag that stays nil unless it is given
+type optionalBool struct {
+	value **bool
+}
+
+func (b optionalBool) String() string {
+	if b.value == nil || *b.value == nil {
+		return ""
+	}
+	return strconv.FormatBool(**b.value)
+}
+
+func (b optionalBool) Set(value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
 	}
+	*b.value = &parsed
+	return nil
 }
+
+func (b optionalBool) IsBoolFlag() bool { return true }
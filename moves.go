@@ -9,35 +9,100 @@ import (
 )
 
 func (gs *GameState) ExtendedStringToMove(extendedMove string) (move *Move, err error) {
+	move, startSquare, err := gs.extendedToMove(extendedMove)
+	if err != nil {
+		return
+	}
+	endSquare := move.Target
+
+	newState, err := gs.ApplyExtendedMove(extendedMove)
+	if err != nil {
+		return
+	}
+
+	move.IsCheck = newState.IsInCheck(newState.PlayerTurn)
+	if move.IsCheck && newState.IsCheckmate() {
+		move.IsCheckmate = true
+		move.IsCheck = false
+	}
+	if move.IsDrop || move.IsShortCastle || move.IsLongCastle {
+		return
+	}
+
+	if move.PieceType == Pawn {
+		if move.IsCapture {
+			move.Discriminator = string(startSquare[0])
+		}
+		return
+	}
+
+	// Only other pieces that can legally reach the target make the move
+	// ambiguous; a pinned piece never needs to be told apart.
+	var ambiguous []string
+	for _, legalMove := range gs.LegalMoves() {
+		fromSquare := legalMove[:2]
+		if fromSquare == startSquare || legalMove[2:4] != endSquare {
+			continue
+		}
+		if p, ok := gs.Pieces[fromSquare]; ok && p.PieceType == move.PieceType {
+			ambiguous = append(ambiguous, fromSquare)
+		}
+	}
+	if len(ambiguous) == 0 {
+		return
+	}
+
+	var sharesFile, sharesRank bool
+	for _, square := range ambiguous {
+		sharesFile = sharesFile || square[0] == startSquare[0]
+		sharesRank = sharesRank || square[1] == startSquare[1]
+	}
+	switch {
+	case !sharesFile:
+		move.Discriminator = string(startSquare[0])
+	case !sharesRank:
+		move.Discriminator = string(startSquare[1])
+	default:
+		move.Discriminator = startSquare
+	}
+
+	return
+}
+
+func (gs *GameState) extendedToMove(extendedMove string) (move *Move, startSquare string, err error) {
+	if len(extendedMove) == 4 && extendedMove[1] == '@' {
+		move, err = ParseMoveString(extendedMove)
+		if err == nil {
+			if _, occupied := gs.Pieces[move.Target]; occupied {
+				err = fmt.Errorf("Cannot drop onto occupied square %s\n", move.Target)
+			}
+		}
+		return
+	}
 	if inputLen := len(extendedMove); !(inputLen == 4 || inputLen == 5) {
 		err = fmt.Errorf("Invalid move length.\n")
 		return
 	}
 
-	move = &Move{}
-
 	startSquare, endSquare := extendedMove[:2], extendedMove[2:4]
+	if !squareRE.MatchString(startSquare) || !squareRE.MatchString(endSquare) {
+		err = fmt.Errorf("Invalid squares in move: %s\n", extendedMove)
+		return
+	}
 
 	movedPiece, ok := gs.Pieces[startSquare]
 	if !ok {
 		err = fmt.Errorf("No piece found on %s\n", startSquare)
 		return
 	}
+	if movedPiece.PlayerColor != gs.PlayerTurn {
+		err = fmt.Errorf("Piece on %s does not belong to the player to move\n", startSquare)
+		return
+	}
 
-	movedPiece.Square = endSquare
-
-	move.Target = endSquare
-	move.PieceType = movedPiece.PieceType
-
-	var similarPieces []piece
-	for s, p := range gs.Pieces {
-		if s == startSquare {
-			continue
-		}
-
-		if p.PlayerColor == movedPiece.PlayerColor && p.PieceType == move.PieceType {
-			similarPieces = append(similarPieces, p)
-		}
+	move = &Move{
+		Target:    endSquare,
+		PieceType: movedPiece.PieceType,
 	}
 
 	if len(extendedMove) == 5 {
@@ -50,170 +115,149 @@ func (gs *GameState) ExtendedStringToMove(extendedMove string) (move *Move, err
 			move.PromoteTo = Bishop
 		case "n":
 			move.PromoteTo = Knight
+		case "k":
+			move.PromoteTo = King
 		default:
 			err = fmt.Errorf("Invalid promotion: %v\n", extendedMove[4])
 			return
 		}
-		movedPiece.PieceType = move.PromoteTo
-	}
-
-	var newState *GameState = &GameState{
-		PlayerTurn: gs.PlayerTurn,
 	}
-	newState.Pieces = make(map[string]piece)
-	maps.Copy(newState.Pieces, gs.Pieces)
 
-	delete(newState.Pieces, startSquare)
-	newState.Pieces[endSquare] = movedPiece
-
-	_, isCapture := gs.Pieces[endSquare]
-	move.IsCapture = isCapture
-
-	var kingSquare string
-	move.IsCheck, kingSquare = newState.IsGivingCheck(movedPiece.PlayerColor)
-
-	if move.IsCheck {
-		move.IsCheckmate, err = gs.IsCheckmated(kingSquare)
-		if move.IsCheckmate {
-			move.IsCheck = false
-		}
+	_, move.IsCapture = gs.Pieces[endSquare]
+	if move.PieceType == Pawn && startSquare[0] != endSquare[0] {
+		// A diagonal pawn move onto an empty square is an en passant capture
+		move.IsCapture = true
 	}
 
 	if move.PieceType == King {
-		if extendedMove == "e1g1" || extendedMove == "e8g8" {
-			move.IsShortCastle = true
-		}
-
-		if extendedMove == "e1c1" || extendedMove == "e8c8" {
-			move.IsLongCastle = true
-		}
-	}
-
-	if move.PieceType == Pawn && move.IsCapture {
-		move.Discriminator = string(startSquare[0])
-	}
-
-	var ambigious []string
-	for _, p := range similarPieces {
-		possibleMoves, _ := gs.calculatePossibleMoves(p)
-		if slices.Contains(possibleMoves, endSquare) {
-			ambigious = append(ambigious, p.Square)
-		}
-	}
-	switch len(ambigious) {
-	case 0:
-	case 1:
-		f1, r1 := startSquare[0], startSquare[1]
-		f2 := ambigious[0][0]
-		if f1 != f2 {
-			move.Discriminator = string(f1)
+		if gs.Chess960 {
+			// Chess960 castling is written as the king capturing its own rook
+			if target, ok := gs.Pieces[endSquare]; ok &&
+				target.PlayerColor == movedPiece.PlayerColor &&
+				slices.Contains(gs.CastlingRooks, endSquare) {
+				move.IsCapture = false
+				move.IsShortCastle = endSquare[0] > startSquare[0]
+				move.IsLongCastle = !move.IsShortCastle
+			}
 		} else {
-			move.Discriminator = string(r1)
+			switch int(endSquare[0]) - int(startSquare[0]) {
+			case 2:
+				move.IsShortCastle = true
+			case -2:
+				move.IsLongCastle = true
+			}
 		}
-	default:
-		move.Discriminator = startSquare
 	}
-
 	return
 }
 
-func (gs *GameState) IsCheckmated(kingSqare string) (isCheckmate bool, err error) {
-	king, ok := gs.Pieces[kingSqare]
-	if !ok {
-		err = fmt.Errorf("No piece found found on %s\n", kingSqare)
-		return
-	}
-
-	if king.PieceType != King {
-		err = fmt.Errorf("No king found\n")
+func (gs *GameState) ApplyExtendedMove(extendedMove string) (newGameState *GameState, err error) {
+	move, startSquare, err := gs.extendedToMove(extendedMove)
+	if err != nil {
 		return
 	}
 
-	var kingCanMove bool = false
-	var canCapture bool = true
-	var canBlock bool = false
-
-	kingMoves, err := gs.calculatePossibleMoves(king)
+	newGameState, _, err = gs.movePiece(move, gs.PlayerTurn, startSquare)
 	if err != nil {
 		return
 	}
+	newGameState.PlayerTurn = opponent(gs.PlayerTurn)
+	return
+}
 
-	var opponentMoves []string
-	var checkingPiece []piece
-	var ownPiecesMoves []string
-	for _, piece := range gs.Pieces {
-		if piece.PlayerColor == king.PlayerColor {
-			if possibleMoves, errMoves := gs.calculatePossibleMoves(piece); errMoves != nil {
-				continue
-			} else {
-				ownPiecesMoves = append(ownPiecesMoves, possibleMoves...)
+// LegalMoves lists every legal move for the player to move in extended
+// notation, sorted so the result is stable between calls.
+func (gs *GameState) LegalMoves() (moves []string) {
+	rules := gs.rules()
+	candidates := rules.ExtraMoves(gs)
+	for _, p := range gs.Pieces {
+		if p.PlayerColor != gs.PlayerTurn {
+			continue
+		}
+		squares, err := gs.calculatePossibleMoves(p)
+		if err != nil {
+			continue
+		}
+		for _, sq := range squares {
+			if p.PieceType == Pawn && sq[0] != p.Square[0] {
+				if _, occupied := gs.Pieces[sq]; !occupied && sq != gs.EnPassant {
+					continue
+				}
+			}
+			if p.PieceType == Pawn && (sq[1] == '8' || sq[1] == '1') {
+				for _, promoteTo := range rules.PromotionPieces() {
+					candidates = append(candidates, p.Square+sq+strings.ToLower(string(promoteTo)))
+				}
 				continue
 			}
+			candidates = append(candidates, p.Square+sq)
 		}
-		pieceMoves, moveErr := gs.calculatePossibleMoves(piece)
-		if moveErr != nil {
+	}
+	for _, c := range candidates {
+		move, startSquare, err := gs.extendedToMove(c)
+		if err != nil {
 			continue
 		}
-
-		if slices.Contains(pieceMoves, king.Square) {
-			checkingPiece = append(checkingPiece, piece)
+		nextState, _, err := gs.movePiece(move, gs.PlayerTurn, startSquare)
+		if err != nil {
+			continue
+		}
+		nextState.PlayerTurn = opponent(gs.PlayerTurn)
+		if rules.IsLegal(gs, nextState, move) {
+			moves = append(moves, c)
 		}
-
-		opponentMoves = append(opponentMoves, pieceMoves...)
 	}
+	moves = rules.FilterMoves(gs, moves)
+	slices.Sort(moves)
+	return
+}
 
-	for _, km := range kingMoves {
-		if !slices.Contains(opponentMoves, km) {
-			kingCanMove = true
-			break
-		}
+func (gs *GameState) IsCheckmate() bool {
+	return gs.IsInCheck(gs.PlayerTurn) && len(gs.LegalMoves()) == 0
+}
+
+func (gs *GameState) IsStalemate() bool {
+	return !gs.IsInCheck(gs.PlayerTurn) && len(gs.LegalMoves()) == 0
+}
+
+func (gs *GameState) IsInCheck(color PlayerColor) bool {
+	return gs.rules().InCheck(gs, color)
+}
+
+func (gs *GameState) IsGivingCheck(color PlayerColor) (bool, string) {
+	kingSquare := gs.kingSquare(opponent(color))
+	if kingSquare == "" {
+		return false, ""
 	}
+	return gs.isSquareAttacked(kingSquare, color), kingSquare
+}
 
-	for _, cp := range checkingPiece {
-		if !slices.Contains(ownPiecesMoves, cp.Square) {
-			canCapture = false
+func (gs *GameState) kingSquare(color PlayerColor) string {
+	for s, p := range gs.Pieces {
+		if p.PieceType == King && p.PlayerColor == color {
+			return s
 		}
+	}
+	return ""
+}
 
-		if len(checkingPiece) != 1 {
+func (gs *GameState) isSquareAttacked(square string, by PlayerColor) bool {
+	for _, p := range gs.Pieces {
+		if p.PlayerColor != by {
 			continue
 		}
-		if cp.PieceType == Queen || cp.PieceType == Rook || cp.PieceType == Bishop {
-			var pathToKing []string
-			pathToKing, err = gs.calcPathToKing(cp, king)
-			if err != nil {
-				return
-			}
-
-			for _, ownMove := range ownPiecesMoves {
-				if slices.Contains(pathToKing, ownMove) {
-					canBlock = true
-					break
-				}
-			}
+		if slices.Contains(gs.calculateAttacks(p), square) {
+			return true
 		}
 	}
-
-	isCheckmate = !(kingCanMove || canCapture || canBlock)
-	return
+	return false
 }
 
-func (gs *GameState) IsGivingCheck(color PlayerColor) (bool, string) {
-	for _, piece := range gs.Pieces {
-		if piece.PlayerColor == color {
-			validMoves, err := gs.calculatePossibleMoves(piece)
-			if err != nil {
-				continue
-			}
-			for _, s := range validMoves {
-				if p, exists := gs.Pieces[s]; exists {
-					if p.PieceType == King && p.PlayerColor != color {
-						return true, p.Square
-					}
-				}
-			}
-		}
+func opponent(color PlayerColor) PlayerColor {
+	if color == White {
+		return Black
 	}
-	return false, ""
+	return White
 }
 
 func (m *Move) MoveToStandardNotation() (moveString string) {
@@ -248,6 +292,8 @@ func (m *Move) MoveToStandardNotation() (moveString string) {
 		promotion = "=" + "B"
 	case Knight:
 		promotion = "=" + "N"
+	case King:
+		promotion = "=" + "K"
 	default:
 		promotion = ""
 	}
@@ -261,38 +307,40 @@ func (m *Move) MoveToStandardNotation() (moveString string) {
 		checkSymbol = ""
 	}
 
-	moveString = pieceAbb + m.Discriminator + capture + m.Target + promotion + checkSymbol
+	switch {
+	case m.IsDrop:
+		moveString = dropString(m.PieceType, m.Target) + checkSymbol
+	case m.IsShortCastle:
+		moveString = shortCastle + checkSymbol
+	case m.IsLongCastle:
+		moveString = longCastle + checkSymbol
+	default:
+		moveString = pieceAbb + m.Discriminator + capture + m.Target + promotion + checkSymbol
+	}
 	return
 }
 
-func (gs *GameState) PVMovesToStandard(pv []string, pvMoveCounter int, turn PlayerColor) (pgnMoves string, err error) {
-	pgnMoves = "{"
-	var pvGameState *GameState = &GameState{
-		PlayerTurn: gs.PlayerTurn,
-		Pieces:     make(map[string]piece),
-	}
-	maps.Copy(pvGameState.Pieces, gs.Pieces)
+// PVToStandard converts an engine line to SAN. The line stops once it
+// repeats a position for the third time, as the game would be drawn there.
+func (gs *GameState) PVToStandard(pv []string) (moves []string, repetition bool) {
+	pvGameState := gs.Copy()
 
 	for _, pvMoveString := range pv {
 		pvMove, err := pvGameState.ExtendedStringToMove(pvMoveString)
 		if err != nil {
-			//log.Printf("Unable to parse extended PV move: %s\n", err)
 			break
 		}
 		standardMove := pvMove.MoveToStandardNotation()
-		if pvGameState.PlayerTurn == Black {
-			pgnMoves = fmt.Sprintf("%s %s", pgnMoves, standardMove)
-			pvMoveCounter++
-		} else {
-			pgnMoves = fmt.Sprintf("%s %d. %s", pgnMoves, pvMoveCounter, standardMove)
-		}
 		pvGameState, _, err = pvGameState.ApplyMove(pvMove, pvGameState.PlayerTurn)
 		if err != nil {
-			//log.Printf("Unable to apply move: %v\n", pvMove)
+			break
+		}
+		moves = append(moves, standardMove)
+		if pvGameState.IsThreefoldRepetition() {
+			repetition = true
 			break
 		}
 	}
-	pgnMoves = fmt.Sprintf("%s }", pgnMoves)
 	return
 }
 
@@ -324,6 +372,24 @@ func (gs *GameState) FindPossibleSquares(move *Move, turn PlayerColor) (squares
 func (gs *GameState) movePiece(
 	move *Move, turn PlayerColor, sourceSquare string,
 ) (newGameState *GameState, extendedMoveString string, err error) {
+	if move.IsDrop {
+		newGameState = gs.Copy()
+		pocket := newGameState.Pockets[turn]
+		i := slices.Index(pocket, move.PieceType)
+		if i < 0 {
+			err = fmt.Errorf("No %s to drop in pocket\n", dropString(move.PieceType, move.Target))
+			return
+		}
+		newGameState.Pockets[turn] = slices.Delete(pocket, i, i+1)
+		newGameState.Pieces[move.Target] = piece{
+			PieceType:   move.PieceType,
+			PlayerColor: turn,
+			Square:      move.Target,
+		}
+		newGameState.finishMove(gs, move, turn, sourceSquare)
+		extendedMoveString = dropString(move.PieceType, move.Target)
+		return
+	}
 	if sourceSquare == "" {
 		err = fmt.Errorf("Source square not found\n")
 		return
@@ -335,10 +401,22 @@ func (gs *GameState) movePiece(
 		err = fmt.Errorf("Piece not found\n")
 		return
 	}
+	if move.IsLongCastle || move.IsShortCastle {
+		extendedMoveString, err = newGameState.castle(move, turn, sourceSquare)
+		if err != nil {
+			return
+		}
+		newGameState.finishMove(gs, move, turn, sourceSquare)
+		return
+	}
 	movedPiece.Square = move.Target
 
 	var promoteTo string
 	if move.PromoteTo != "" {
+		if !slices.Contains(gs.rules().PromotionPieces(), move.PromoteTo) {
+			err = fmt.Errorf("Cannot promote to %s in this variant\n", move.PromoteTo)
+			return
+		}
 		movedPiece.PieceType = move.PromoteTo
 		switch move.PromoteTo {
 		case Queen:
@@ -349,6 +427,8 @@ func (gs *GameState) movePiece(
 			promoteTo = "b"
 		case Knight:
 			promoteTo = "n"
+		case King:
+			promoteTo = "k"
 		}
 	}
 
@@ -378,40 +458,9 @@ func (gs *GameState) movePiece(
 		}
 	}
 
-	if move.IsLongCastle {
-		var rookSource string
-		var rookDest string
-		if turn == Black {
-			rookSource = "a8"
-			rookDest = "d8"
-		} else {
-			rookSource = "a1"
-			rookDest = "d1"
-		}
-		qRook := newGameState.Pieces[rookSource]
-		qRook.Square = rookDest
-		delete(newGameState.Pieces, rookSource)
-		newGameState.Pieces[rookDest] = qRook
-	}
-
-	if move.IsShortCastle {
-		var rookSource string
-		var rookDest string
-		if turn == Black {
-			rookSource = "h8"
-			rookDest = "f8"
-		} else {
-			rookSource = "h1"
-			rookDest = "f1"
-		}
-		kRook := newGameState.Pieces[rookSource]
-		kRook.Square = rookDest
-		delete(newGameState.Pieces, rookSource)
-		newGameState.Pieces[rookDest] = kRook
-	}
-
-	newGameState.Pieces[move.Target] = movedPiece
 	delete(newGameState.Pieces, sourceSquare)
+	newGameState.Pieces[move.Target] = movedPiece
+	newGameState.finishMove(gs, move, turn, sourceSquare)
 
 	extendedMoveString = sourceSquare + move.Target + promoteTo
 	if moveLen := len(extendedMoveString); !(moveLen == 4 || moveLen == 5) {
@@ -421,6 +470,59 @@ func (gs *GameState) movePiece(
 	return
 }
 
+// castle moves the king and the castling rook to their destinations. The
+// squares only depend on the side castled, which covers Chess960 as well as
+// standard chess.
+func (gs *GameState) castle(move *Move, turn PlayerColor, kingSquare string) (extendedMoveString string, err error) {
+	rookSquare, err := gs.castlingRook(turn, move.IsShortCastle)
+	if err != nil {
+		return
+	}
+	kingDest, rookDest := castlingDestinations(kingSquare[1], move.IsShortCastle)
+
+	king := gs.Pieces[kingSquare]
+	rook := gs.Pieces[rookSquare]
+	delete(gs.Pieces, kingSquare)
+	delete(gs.Pieces, rookSquare)
+	king.Square = kingDest
+	rook.Square = rookDest
+	gs.Pieces[kingDest] = king
+	gs.Pieces[rookDest] = rook
+
+	if gs.Chess960 {
+		extendedMoveString = kingSquare + rookSquare
+	} else {
+		extendedMoveString = kingSquare + kingDest
+	}
+	return
+}
+
+// finishMove updates the counters, history, castling rights and en passant
+// square once the pieces of a move have been placed.
+func (gs *GameState) finishMove(previous *GameState, move *Move, turn PlayerColor, sourceSquare string) {
+	gs.History = append(gs.History, previous.Hash())
+	if move.PieceType == Pawn || move.IsCapture {
+		gs.HalfmoveClock = 0
+	} else {
+		gs.HalfmoveClock++
+	}
+	if turn == Black {
+		gs.FullmoveNumber++
+	}
+
+	if move.PieceType == King {
+		gs.dropCastlingRights(turn)
+	}
+	gs.updateCastlingRights(sourceSquare, move.Target)
+	gs.EnPassant = ""
+	if move.PieceType == Pawn && !move.IsDrop {
+		if rankDiff := int(move.Target[1]) - int(sourceSquare[1]); rankDiff == 2 || rankDiff == -2 {
+			gs.EnPassant = string(sourceSquare[0]) + string(sourceSquare[1]+byte(rankDiff/2))
+		}
+	}
+	gs.rules().AfterMove(previous, gs, move, sourceSquare)
+}
+
 func (gs *GameState) ApplyMove(move *Move, turn PlayerColor) (newGameState *GameState, extendedMoveString string, err error) {
 	var nextTurn PlayerColor
 	switch gs.PlayerTurn {
@@ -433,33 +535,38 @@ func (gs *GameState) ApplyMove(move *Move, turn PlayerColor) (newGameState *Game
 		return
 	}
 
-	if move.IsLongCastle && turn == Black {
-		move.Target = "c8"
-	}
-	if move.IsLongCastle && turn == White {
-		move.Target = "c1"
-	}
-	if move.IsShortCastle && turn == Black {
-		move.Target = "g8"
-	}
-	if move.IsShortCastle && turn == White {
-		move.Target = "g1"
+	var possibleSquares []string
+	if move.IsDrop {
+		possibleSquares = []string{""}
+	} else if move.IsLongCastle || move.IsShortCastle {
+		var kingSquare string
+		kingSquare, err = gs.castlingTarget(move, turn)
+		if err != nil {
+			return
+		}
+		possibleSquares = []string{kingSquare}
+	} else {
+		possibleSquares = gs.FindPossibleSquares(move, turn)
 	}
 
-	possibleSquares := gs.FindPossibleSquares(move, turn)
-
 	for _, sq := range possibleSquares {
-		tempGS := gs.Copy()
-		tempGS, extendedMoveString, err = tempGS.movePiece(move, turn, sq)
-		if err != nil {
+		tempGS, tempExtended, moveErr := gs.Copy().movePiece(move, turn, sq)
+		if moveErr != nil {
+			err = moveErr
 			return
 		}
-		if isCheck, _ := tempGS.IsGivingCheck(nextTurn); !isCheck {
-			newGameState = tempGS
-			break
+		if !gs.rules().IsLegal(gs, tempGS, move) {
+			continue
+		}
+		if newGameState != nil {
+			newGameState = nil
+			err = fmt.Errorf("Ambiguous move: %s and %s both reach %s\n", extendedMoveString[:2], sq, move.Target)
+			return
 		}
+		newGameState, extendedMoveString = tempGS, tempExtended
 	}
 	if newGameState == nil {
+		extendedMoveString = ""
 		err = fmt.Errorf("No game state\n")
 		return
 	}
@@ -483,13 +590,95 @@ func (gs *GameState) ApplyAndTranslateMove(ms string, turn PlayerColor) (nextSta
 
 func (gs *GameState) Copy() (copyGS *GameState) {
 	copyGS = &GameState{
-		PlayerTurn: gs.PlayerTurn,
-		Pieces:     make(map[string]piece),
+		PlayerTurn:     gs.PlayerTurn,
+		Pieces:         make(map[string]piece),
+		CastlingRooks:  slices.Clone(gs.CastlingRooks),
+		Chess960:       gs.Chess960,
+		EnPassant:      gs.EnPassant,
+		HalfmoveClock:  gs.HalfmoveClock,
+		FullmoveNumber: gs.FullmoveNumber,
+		History:        slices.Clone(gs.History),
+		Variant:        gs.Variant,
+		Checks:         gs.Checks,
+		Pockets:        [2][]PieceType{slices.Clone(gs.Pockets[White]), slices.Clone(gs.Pockets[Black])},
+		Promoted:       slices.Clone(gs.Promoted),
 	}
 	maps.Copy(copyGS.Pieces, gs.Pieces)
 	return
 }
 
+// updateCastlingRights drops the right of any castling rook that has left,
+// or been captured on, one of the given squares.
+func (gs *GameState) updateCastlingRights(squares ...string) {
+	gs.CastlingRooks = slices.DeleteFunc(gs.CastlingRooks, func(rookSquare string) bool {
+		return slices.Contains(squares, rookSquare)
+	})
+}
+
+func (gs *GameState) dropCastlingRights(color PlayerColor) {
+	backRank := backRank(color)
+	gs.CastlingRooks = slices.DeleteFunc(gs.CastlingRooks, func(rookSquare string) bool {
+		return rookSquare[1] == backRank
+	})
+}
+
+func backRank(color PlayerColor) byte {
+	if color == Black {
+		return '8'
+	}
+	return '1'
+}
+
+// castlingRook finds the rook the player may castle with on the given side.
+func (gs *GameState) castlingRook(color PlayerColor, short bool) (rookSquare string, err error) {
+	kingSquare := gs.kingSquare(color)
+	if kingSquare == "" {
+		err = fmt.Errorf("No king found\n")
+		return
+	}
+	for _, sq := range gs.CastlingRooks {
+		if sq[1] != kingSquare[1] || sq[1] != backRank(color) {
+			continue
+		}
+		if short == (sq[0] > kingSquare[0]) {
+			rookSquare = sq
+			return
+		}
+	}
+	err = fmt.Errorf("No castling rights for %v\n", color)
+	return
+}
+
+func castlingDestinations(rank byte, short bool) (kingDest, rookDest string) {
+	if short {
+		return "g" + string(rank), "f" + string(rank)
+	}
+	return "c" + string(rank), "d" + string(rank)
+}
+
+// castlingTarget checks that the castling move is legal and returns the king
+// square, setting the move target to the square used in extended notation.
+func (gs *GameState) castlingTarget(move *Move, turn PlayerColor) (kingSquare string, err error) {
+	kingSquare = gs.kingSquare(turn)
+	if kingSquare == "" {
+		err = fmt.Errorf("No king found\n")
+		return
+	}
+	rookSquare, err := gs.castlingRook(turn, move.IsShortCastle)
+	if err != nil {
+		return
+	}
+	move.Target, _ = castlingDestinations(kingSquare[1], move.IsShortCastle)
+	if gs.Chess960 {
+		move.Target = rookSquare
+	}
+	king := gs.Pieces[kingSquare]
+	if !slices.Contains(gs.calcCastlingMoves(rune(kingSquare[1]), rune(kingSquare[0]), king), move.Target) {
+		err = fmt.Errorf("Castling is not allowed\n")
+	}
+	return
+}
+
 func (gs *GameState) isValidMove(move *Move, p piece) (isValid bool, err error) {
 	squares, err := gs.calculatePossibleMoves(p)
 	isValid = slices.Contains(squares, move.Target)
@@ -524,161 +713,34 @@ func (gs *GameState) calculatePossibleMoves(p piece) (squares []string, err erro
 		calcFunc = gs.calcPawnMoves
 	}
 	squares = calcFunc(rank, file, p)
+	if p.PieceType == King {
+		squares = append(squares, gs.calcCastlingMoves(rank, file, p)...)
+	}
 	return
 }
 
-func (gs *GameState) calcPathToKing(p piece, k piece) (pathToKing []string, err error) {
+func (gs *GameState) calculateAttacks(p piece) (squares []string) {
 	rank := rune(p.Square[1])
 	file := rune(p.Square[0])
-	square := p.Square
-	if !squareRE.MatchString(square) {
-		err = fmt.Errorf("Not a valid square: %v\n", square)
-		return
-	}
-	if _, ok := IsValidPieceType[p.PieceType]; !ok {
-		err = fmt.Errorf("Not a valid piece: %v\n", p.PieceType)
-		return
-	}
-	var calcFunc func(rune, rune, piece, piece) []string
 	switch p.PieceType {
-	case Bishop:
-		calcFunc = gs.calcBishopPathToKing
-	case Rook:
-		calcFunc = gs.calcRookPathToKing
-	case Queen:
-		calcFunc = gs.calcQueenPathToKing
-	default:
-		err = fmt.Errorf("Invalid piece type: %v\n", p.PieceType)
-		return
-	}
-	pathToKing = calcFunc(rank, file, p, k)
-	return
-}
-
-func (gs *GameState) calcMovesUpRight(rank, file rune, p piece) (squares []string) {
-	for r, f := rank+1, file+1; r <= '8' && f <= 'h'; r, f = r+1, f+1 {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if isValid {
-			squares = append(squares, canidateSquare)
-		}
-	}
-	return
-}
-
-func (gs *GameState) calcMovesUpLeft(rank, file rune, p piece) (squares []string) {
-	for r, f := rank+1, file-1; r <= '8' && f >= 'a'; r, f = r+1, f-1 {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if isValid {
-			squares = append(squares, canidateSquare)
-		}
-	}
-	return
-}
-
-func (gs *GameState) calcMovesDownRight(rank, file rune, p piece) (squares []string) {
-	for r, f := rank-1, file+1; r >= '1' && f <= 'h'; r, f = r-1, f+1 {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if isValid {
-			squares = append(squares, canidateSquare)
-		}
-	}
-	return
-}
-
-func (gs *GameState) calcMovesDownLeft(rank, file rune, p piece) (squares []string) {
-	for r, f := rank-1, file-1; r >= '1' && f >= 'a'; r, f = r-1, f-1 {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if isValid {
-			squares = append(squares, canidateSquare)
-		}
-	}
-	return
-}
-
-func (gs *GameState) calcMovesLeft(rank, file rune, p piece) (squares []string) {
-	for r, f := rank, file-1; f >= 'a'; f-- {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if !isValid {
-			break
-		}
-		squares = append(squares, canidateSquare)
-	}
-	return
-}
-
-func (gs *GameState) calcMovesUp(rank, file rune, p piece) (squares []string) {
-	for r, f := rank+1, file; r <= '8'; r++ {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if !isValid {
-			break
-		}
-		squares = append(squares, canidateSquare)
-	}
-	return
-}
-
-func (gs *GameState) calcMovesRight(rank, file rune, p piece) (squares []string) {
-	for r, f := rank, file+1; f <= 'h'; f++ {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if !isValid {
-			break
+	case King:
+		squares = gs.calcKingMoves(rank, file, p)
+	case Pawn:
+		nextRank := rank + 1
+		if p.PlayerColor == Black {
+			nextRank = rank - 1
 		}
-		squares = append(squares, canidateSquare)
-	}
-	return
-}
-
-func (gs *GameState) calcMovesDown(rank, file rune, p piece) (squares []string) {
-	for r, f := rank-1, file; r >= '1'; r-- {
-		canidateSquare, isValid := gs.checkGameSquare(r, f, p)
-		if !isValid {
-			break
+		if nextRank < '1' || nextRank > '8' {
+			return
 		}
-		squares = append(squares, canidateSquare)
-	}
-	return
-}
-
-func (gs *GameState) calcBishopPathToKing(rank, file rune, p, k piece) (pathToKing []string) {
-	var bishopMoves []func(rune, rune, piece) []string = []func(rune, rune, piece) []string{
-		gs.calcMovesUpLeft,
-		gs.calcMovesUpRight,
-		gs.calcMovesDownLeft,
-		gs.calcMovesDownRight,
-	}
-	for _, f := range bishopMoves {
-		squares := f(rank, file, p)
-
-		if slices.Contains(squares, k.Square) {
-			pathToKing = squares
-			break
+		if leftFile := file - 1; leftFile >= 'a' {
+			squares = append(squares, string(leftFile)+string(nextRank))
 		}
-	}
-	return
-}
-
-func (gs *GameState) calcRookPathToKing(rank, file rune, p, k piece) (pathToKing []string) {
-	var rookMoves []func(rune, rune, piece) []string = []func(rune, rune, piece) []string{
-		gs.calcMovesLeft,
-		gs.calcMovesRight,
-		gs.calcMovesDown,
-		gs.calcMovesUp,
-	}
-	for _, f := range rookMoves {
-		squares := f(rank, file, p)
-
-		if slices.Contains(squares, k.Square) {
-			pathToKing = squares
-			break
+		if rightFile := file + 1; rightFile <= 'h' {
+			squares = append(squares, string(rightFile)+string(nextRank))
 		}
-	}
-	return
-}
-
-func (gs *GameState) calcQueenPathToKing(rank, file rune, p, k piece) (pathToKing []string) {
-	pathToKing = gs.calcBishopPathToKing(rank, file, p, k)
-	if len(pathToKing) == 0 {
-		pathToKing = gs.calcRookPathToKing(rank, file, p, k)
+	default:
+		squares, _ = gs.calculatePossibleMoves(p)
 	}
 	return
 }
@@ -742,40 +804,65 @@ func (gs *GameState) calcKingMoves(rank, file rune, p piece) (squares []string)
 		}
 	}
 
-	var startingSquare string
-	if p.PlayerColor == Black {
-		startingSquare = "e8"
-	} else {
-		startingSquare = "e1"
-	}
-	if p.Square == startingSquare {
-		kingRookSquare := string(file+3) + string(rank)
-		if otherPiece, ok := gs.Pieces[kingRookSquare]; ok &&
-			otherPiece.PieceType == Rook &&
-			otherPiece.PlayerColor == p.PlayerColor {
-			kingBishopSquare := string(file+1) + string(rank)
-			kingKnightSquare := string(file+2) + string(rank)
-			_, knightSquareOccupied := gs.Pieces[kingKnightSquare]
-			_, bishopSquareOccupied := gs.Pieces[kingBishopSquare]
-			if !bishopSquareOccupied && !knightSquareOccupied {
-				squares = append(squares, kingKnightSquare)
-			}
+	return
+}
 
+// calcCastlingMoves returns the target squares of the king's castling moves.
+// In Chess960 the target is the rook's square, matching UCI_Chess960.
+func (gs *GameState) calcCastlingMoves(rank, file rune, p piece) (squares []string) {
+	if byte(rank) != backRank(p.PlayerColor) {
+		return
+	}
+	attacker := opponent(p.PlayerColor)
+	if gs.isSquareAttacked(p.Square, attacker) {
+		return
+	}
+	for _, rookSquare := range gs.CastlingRooks {
+		if rookSquare[1] != byte(rank) {
+			continue
+		}
+		rook, ok := gs.Pieces[rookSquare]
+		if !ok || rook.PieceType != Rook || rook.PlayerColor != p.PlayerColor {
+			continue
 		}
-		queenRookSquare := string(file-4) + string(rank)
-		if otherPiece, ok := gs.Pieces[queenRookSquare]; ok &&
-			otherPiece.PieceType == Rook &&
-			otherPiece.PlayerColor == p.PlayerColor {
-			queenBishopSquare := string(file-2) + string(rank)
-			queenKnightSquare := string(file-3) + string(rank)
-			queenSquare := string(file-1) + string(rank)
-			_, knightSquareOccupied := gs.Pieces[queenKnightSquare]
-			_, bishopSquareOccupied := gs.Pieces[queenBishopSquare]
-			_, queenSquareOccupied := gs.Pieces[queenSquare]
-			if !bishopSquareOccupied && !knightSquareOccupied && !queenSquareOccupied {
-				squares = append(squares, queenBishopSquare)
+		short := rune(rookSquare[0]) > file
+		kingDest, rookDest := castlingDestinations(byte(rank), short)
+
+		// Every square the king and rook cross must be empty apart from the
+		// king and rook themselves, and the king may not cross an attacked
+		// square.
+		lowFile := min(file, rune(rookSquare[0]), rune(kingDest[0]), rune(rookDest[0]))
+		highFile := max(file, rune(rookSquare[0]), rune(kingDest[0]), rune(rookDest[0]))
+		pathClear := true
+		for f := lowFile; f <= highFile; f++ {
+			sq := string(f) + string(rank)
+			if sq == p.Square || sq == rookSquare {
+				continue
+			}
+			if _, occupied := gs.Pieces[sq]; occupied {
+				pathClear = false
+				break
+			}
+		}
+		if !pathClear {
+			continue
+		}
+		kingLow, kingHigh := min(file, rune(kingDest[0])), max(file, rune(kingDest[0]))
+		for f := kingLow; f <= kingHigh; f++ {
+			if gs.isSquareAttacked(string(f)+string(rank), attacker) {
+				pathClear = false
+				break
 			}
 		}
+		if !pathClear {
+			continue
+		}
+
+		if gs.Chess960 {
+			squares = append(squares, rookSquare)
+		} else {
+			squares = append(squares, kingDest)
+		}
 	}
 	return
 }
@@ -944,12 +1031,12 @@ func (gs *GameState) calcKnightMoves(rank, file rune, p piece) (squares []string
 
 func (gs *GameState) calcPawnMoves(rank, file rune, p piece) (squares []string) {
 	if p.PlayerColor == Black {
-		startRank := '7'
+		startRanks := gs.rules().PawnStartRanks(p.PlayerColor)
 		nextRank := rank - 1
 		enPassentRank := '4'
 		if canidateSquare, valid := gs.checkPawnMove(nextRank, file); valid {
 			squares = append(squares, canidateSquare)
-			if startRank == rank {
+			if slices.Contains(startRanks, rank) {
 				if canidateSquare, valid = gs.checkPawnMove(rank-2, file); valid {
 					squares = append(squares, canidateSquare)
 				}
@@ -986,12 +1073,12 @@ func (gs *GameState) calcPawnMoves(rank, file rune, p piece) (squares []string)
 			}
 		}
 	} else {
-		startRank := '2'
+		startRanks := gs.rules().PawnStartRanks(p.PlayerColor)
 		nextRank := rank + 1
 		enPassentRank := '5'
 		if canidateSquare, valid := gs.checkPawnMove(nextRank, file); valid {
 			squares = append(squares, canidateSquare)
-			if startRank == rank {
+			if slices.Contains(startRanks, rank) {
 				if canidateSquare, valid = gs.checkPawnMove(rank+2, file); valid {
 					squares = append(squares, canidateSquare)
 				}
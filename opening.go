@@ -0,0 +1,142 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+)
+
+// openingsTSV lists named openings as ECO code, name and moves, in the
+// format of the lichess chess-openings dataset. It is a cut-down selection
+// of about 120 common lines across the ECO volumes, not the whole dataset of
+// several thousand, so it names the family of an opening more than its
+// exact variation.
+//
+//go:embed openings.tsv
+var openingsTSV string
+
+type Opening struct {
+	ECO  string
+	Name string
+}
+
+var (
+	openingsOnce sync.Once
+	openings     map[string]Opening
+)
+
+// openingKey identifies a position by its board, side to move and castling
+// rights, so openings are found whatever order their moves were played in.
+func openingKey(gs *GameState) string {
+	return strings.Join(strings.Fields(gs.FEN())[:3], " ")
+}
+
+func loadOpenings() {
+	openings = make(map[string]Opening)
+	for i, line := range strings.Split(strings.TrimSpace(openingsTSV), "\n")[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			log.Printf("Openings line %d: expected 3 fields\n", i+2)
+			continue
+		}
+		opening := Opening{ECO: fields[0], Name: fields[1]}
+		gs, err := replayOpening(fields[2])
+		if err != nil {
+			log.Printf("Openings line %d: %v\n", i+2, err)
+			continue
+		}
+		openings[openingKey(gs)] = opening
+	}
+}
+
+func replayOpening(movetext string) (gs *GameState, err error) {
+	pgnGame, err := NewPGNReader(strings.NewReader(movetext)).Read()
+	if err != nil {
+		return
+	}
+	gs, err = NewVariantGameState(standardVariant, standardStartingFEN)
+	if err != nil {
+		return
+	}
+	for _, move := range pgnGame.Root.Mainline() {
+		gs, _, err = gs.ApplyAndTranslateMove(move, gs.PlayerTurn)
+		if err != nil {
+			err = fmt.Errorf("unable to play %s: %w", move, err)
+			return
+		}
+	}
+	return
+}
+
+// ClassifyOpening plays the moves from gs and names the deepest position
+// reached that is in the openings table. ply is the number of moves played
+// to reach it; the game leaves known theory with the move after.
+func ClassifyOpening(gs *GameState, moves []string) (opening Opening, ply int, found bool) {
+	openingsOnce.Do(loadOpenings)
+
+	opening, found = openings[openingKey(gs)]
+	for i, move := range moves {
+		next, _, err := gs.ApplyAndTranslateMove(move, gs.PlayerTurn)
+		if err != nil {
+			return
+		}
+		gs = next
+		if named, ok := openings[openingKey(gs)]; ok {
+			opening, ply, found = named, i+1, true
+		}
+	}
+	return
+}
+
+// classifyOpening fills in the opening of games that come without one, such
+// as imported over-the-board games, along with the ECO and Opening tags and
+// the ply the game leaves known theory on. Fields that are already set, by
+// lichess or the game's tags, are kept. Only standard chess is classified.
+func (g *Game) classifyOpening() {
+	if g.Opening.Eco != "" && g.Opening.Name != "" && g.Opening.Ply > 0 {
+		return
+	}
+	if g.Variant != "" && g.Variant != "standard" && g.Variant != "fromPosition" {
+		return
+	}
+	fen := g.InitalFEN
+	if fen == "" {
+		fen = standardStartingFEN
+	}
+	gs, err := NewVariantGameState(standardVariant, fen)
+	if err != nil {
+		return
+	}
+	opening, ply, found := ClassifyOpening(gs, g.MoveTree().Mainline())
+	if !found {
+		return
+	}
+	if g.Opening.Eco == "" {
+		g.Opening.Eco = opening.ECO
+		g.setTag("ECO", opening.ECO)
+	}
+	if g.Opening.Name == "" {
+		g.Opening.Name = opening.Name
+		g.setTag("Opening", opening.Name)
+	}
+	if g.Opening.Ply == 0 {
+		g.Opening.Ply = ply
+	}
+}
+
+// setTag adds a tag to a game read from PGN. Downloaded games have their
+// tags built from the lichess fields when written.
+func (g *Game) setTag(name, value string) {
+	if len(g.Tags) == 0 {
+		return
+	}
+	for i := range g.Tags {
+		if g.Tags[i].Name == name {
+			g.Tags[i].Value = value
+			return
+		}
+	}
+	g.Tags = append(g.Tags, PGNTag{Name: name, Value: value})
+}
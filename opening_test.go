@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpeningsTable(T *testing.T) {
+	lines := strings.Split(strings.TrimSpace(openingsTSV), "\n")[1:]
+	seen := make(map[string]string)
+	for i, line := range lines {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			T.Errorf("Line %d: expected 3 fields, found %d\n", i+2, len(fields))
+			continue
+		}
+		gs, err := replayOpening(fields[2])
+		if err != nil {
+			T.Errorf("Line %d: %s\n", i+2, err.Error())
+			continue
+		}
+		key := openingKey(gs)
+		if name, ok := seen[key]; ok {
+			T.Errorf("Line %d: %s reaches the same position as %s\n", i+2, fields[1], name)
+		}
+		seen[key] = fields[1]
+	}
+}
+
+func TestClassifyOpening(T *testing.T) {
+	tests := []struct {
+		Name  string
+		FEN   string
+		Moves string
+		ECO   string
+		Ply   int
+		Found bool
+	}{
+		{
+			Name:  "main line",
+			Moves: "e4 c5 Nf3 d6 d4 cxd4 Nxd4 Nf6 Nc3 a6 Be3 e5 Nb3",
+			ECO:   "B90",
+			Ply:   11,
+			Found: true,
+		},
+		{
+			Name:  "transposition",
+			Moves: "Nf3 Nf6 c4 e6 d4 b6 g3",
+			ECO:   "E12",
+			Ply:   6,
+			Found: true,
+		},
+		{
+			Name:  "left theory early",
+			Moves: "e4 e5 Ke2 Ke7",
+			ECO:   "C20",
+			Ply:   2,
+			Found: true,
+		},
+		{
+			Name:  "set up position",
+			FEN:   "r1bqkbnr/pppp1ppp/2n5/4p3/4P3/5N2/PPPP1PPP/RNBQKB1R w KQkq - 2 3",
+			Moves: "Bb5 a6",
+			ECO:   "C70",
+			Ply:   2,
+			Found: true,
+		},
+		{
+			Name:  "unknown",
+			Moves: "a3 h6",
+		},
+	}
+
+	for _, test := range tests {
+		fen := test.FEN
+		if fen == "" {
+			fen = standardStartingFEN
+		}
+		gs, err := NewVariantGameState(standardVariant, fen)
+		if err != nil {
+			T.Fatalf("%s: %s\n", test.Name, err.Error())
+		}
+		opening, ply, found := ClassifyOpening(gs, strings.Fields(test.Moves))
+		if found != test.Found || opening.ECO != test.ECO || ply != test.Ply {
+			T.Errorf("%s: found %v %s %s at ply %d, expected %s at ply %d\n", test.Name, found, opening.ECO, opening.Name, ply, test.ECO, test.Ply)
+		}
+	}
+}
+
+func TestClassifyGame(T *testing.T) {
+	tests := []struct {
+		Name    string
+		Tags    string
+		ECO     string
+		Opening string
+		Tagged  bool
+	}{
+		{
+			Name:    "no opening",
+			Tags:    `[Event "Club"]`,
+			ECO:     "C65",
+			Opening: "Ruy Lopez: Berlin Defense",
+			Tagged:  true,
+		},
+		{
+			// The tags of lichess name the variation, which the built in
+			// table may not know
+			Name:    "opening from lichess",
+			Tags:    "[Event \"Rated blitz game\"]\n[ECO \"C67\"]\n[Opening \"Ruy Lopez: Berlin Defense, Rio Gambit Accepted\"]",
+			ECO:     "C67",
+			Opening: "Ruy Lopez: Berlin Defense, Rio Gambit Accepted",
+		},
+		{
+			Name:    "only ECO",
+			Tags:    "[Event \"Club\"]\n[ECO \"C60\"]",
+			ECO:     "C60",
+			Opening: "Ruy Lopez: Berlin Defense",
+			Tagged:  true,
+		},
+	}
+
+	for _, test := range tests {
+		game, err := GameFromPGN([]byte(test.Tags + "\n\n1. e4 e5 2. Nf3 Nc6 3. Bb5 Nf6 4. O-O *\n"))
+		if err != nil {
+			T.Fatalf("%s: %s\n", test.Name, err.Error())
+		}
+		tags := len(game.Tags)
+		game.classifyOpening()
+		if game.Opening.Eco != test.ECO || game.Opening.Name != test.Opening || game.Opening.Ply != 6 {
+			T.Errorf("%s: opening %+v does not match expected\n", test.Name, game.Opening)
+		}
+		if tagged := len(game.Tags) > tags; tagged != test.Tagged {
+			T.Errorf("%s: tags %+v\n", test.Name, game.Tags)
+		} else if tagged && game.Tags[len(game.Tags)-1].Value != test.Opening {
+			T.Errorf("%s: Opening tag %+v does not match expected\n", test.Name, game.Tags[len(game.Tags)-1])
+		}
+	}
+}
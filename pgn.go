@@ -0,0 +1,661 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type pgnTokenType int
+
+const (
+	pgnEOF pgnTokenType = iota
+	pgnSymbol
+	pgnString
+	pgnPeriod
+	pgnNAG
+	pgnComment
+	pgnOpenBracket
+	pgnCloseBracket
+	pgnOpenVariation
+	pgnCloseVariation
+)
+
+type pgnToken struct {
+	Type  pgnTokenType
+	Value string
+	Line  int
+}
+
+// suffixNAGs maps the traditional move suffix annotations to their NAGs
+var suffixNAGs = map[string]int{"!": 1, "?": 2, "!!": 3, "??": 4, "!?": 5, "?!": 6}
+
+type PGNTag struct {
+	Name, Value string
+}
+
+// PGNNode is a single move in a game tree. The first child continues the
+// line and any further children are variations replacing that move.
+type PGNNode struct {
+	Move string
+	NAGs []int
+	// PreComments are written before the move, Comments after it
+	PreComments []string
+	Comments    []string
+	// Clock is the time left after the move in centiseconds and Eval the
+	// evaluation of the position it reaches. They are written as [%clk]
+	// and [%eval] commands in the first comment.
+	Clock *int
+	Eval  *MoveAnalysis
+	// Line is the line of the input the move was read from
+	Line     int
+	Parent   *PGNNode
+	Children []*PGNNode
+}
+
+type PGNGame struct {
+	Tags []PGNTag
+	// Root holds no move; its comments annotate a game without moves
+	Root   *PGNNode
+	Result GameResult
+	// Line is the line of the input the game starts on
+	Line int
+}
+
+// PGNReader reads games in PGN import format, which is lenient about
+// whitespace, move numbers and suffix annotations.
+type PGNReader struct {
+	r           *bufio.Reader
+	line        int
+	atLineStart bool
+	lastRune    rune
+	lastStart   bool
+	peeked      *pgnToken
+}
+
+func NewPGNReader(r io.Reader) *PGNReader {
+	return &PGNReader{r: bufio.NewReader(r), line: 1, atLineStart: true}
+}
+
+func (pr *PGNReader) readRune() (c rune, err error) {
+	c, _, err = pr.r.ReadRune()
+	if err != nil {
+		return
+	}
+	pr.lastRune, pr.lastStart = c, pr.atLineStart
+	pr.atLineStart = c == '\n'
+	if c == '\n' {
+		pr.line++
+	}
+	return
+}
+
+func (pr *PGNReader) unreadRune() {
+	if pr.r.UnreadRune() != nil {
+		return
+	}
+	if pr.lastRune == '\n' {
+		pr.line--
+	}
+	pr.atLineStart = pr.lastStart
+}
+
+// readUntil returns the text up to the delimiter, which is consumed
+func (pr *PGNReader) readUntil(delim rune) (text string, found bool, err error) {
+	var sb strings.Builder
+	for {
+		c, readErr := pr.readRune()
+		if readErr == io.EOF {
+			return sb.String(), false, nil
+		}
+		if readErr != nil {
+			return sb.String(), false, readErr
+		}
+		if c == delim {
+			return sb.String(), true, nil
+		}
+		sb.WriteRune(c)
+	}
+}
+
+func isSymbolRune(c rune) bool {
+	return c < unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c) || strings.ContainsRune("_+#=:-/@", c))
+}
+
+func (pr *PGNReader) token() (tok pgnToken, err error) {
+	if pr.peeked != nil {
+		tok, pr.peeked = *pr.peeked, nil
+		return
+	}
+	for {
+		lineStart := pr.atLineStart
+		var c rune
+		c, err = pr.readRune()
+		if err == io.EOF {
+			return pgnToken{Type: pgnEOF, Line: pr.line}, nil
+		}
+		if err != nil {
+			return
+		}
+		tok.Line = pr.line
+		switch {
+		case unicode.IsSpace(c) || c == '\uFEFF':
+		case c == '%' && lineStart:
+			// Escaped lines carry data for other programs
+			_, _, err = pr.readUntil('\n')
+			if err != nil {
+				return
+			}
+		case c == '<' || c == '>':
+			// Reserved for future expansion
+		case c == ';':
+			tok.Type = pgnComment
+			tok.Value, _, err = pr.readUntil('\n')
+			tok.Value = strings.TrimSpace(tok.Value)
+			return
+		case c == '{':
+			var found bool
+			tok.Type = pgnComment
+			tok.Value, found, err = pr.readUntil('}')
+			if err == nil && !found {
+				err = fmt.Errorf("Line %d: unterminated comment\n", tok.Line)
+			}
+			// Comments may be wrapped over several lines
+			tok.Value = strings.Join(strings.Fields(tok.Value), " ")
+			return
+		case c == '"':
+			tok.Type = pgnString
+			tok.Value, err = pr.readString(tok.Line)
+			return
+		case c == '[':
+			tok.Type = pgnOpenBracket
+			return
+		case c == ']':
+			tok.Type = pgnCloseBracket
+			return
+		case c == '(':
+			tok.Type = pgnOpenVariation
+			return
+		case c == ')':
+			tok.Type = pgnCloseVariation
+			return
+		case c == '.':
+			tok.Type = pgnPeriod
+			return
+		case c == '*':
+			tok.Type, tok.Value = pgnSymbol, string(Unknown)
+			return
+		case c == '$':
+			tok.Type = pgnNAG
+			tok.Value = pr.readWhile(unicode.IsDigit)
+			if tok.Value == "" {
+				err = fmt.Errorf("Line %d: NAG without a number\n", tok.Line)
+			}
+			return
+		case c == '!' || c == '?':
+			suffix := string(c) + pr.readWhile(func(c rune) bool { return c == '!' || c == '?' })
+			nag, ok := suffixNAGs[suffix]
+			if !ok {
+				err = fmt.Errorf("Line %d: unknown annotation %s\n", tok.Line, suffix)
+				return
+			}
+			tok.Type, tok.Value = pgnNAG, strconv.Itoa(nag)
+			return
+		case isSymbolRune(c):
+			tok.Type = pgnSymbol
+			tok.Value = string(c) + pr.readWhile(isSymbolRune)
+			return
+		default:
+			err = fmt.Errorf("Line %d: unexpected character %q\n", tok.Line, c)
+			return
+		}
+	}
+}
+
+func (pr *PGNReader) readWhile(accept func(rune) bool) string {
+	var sb strings.Builder
+	for {
+		c, err := pr.readRune()
+		if err != nil {
+			return sb.String()
+		}
+		if !accept(c) {
+			pr.unreadRune()
+			return sb.String()
+		}
+		sb.WriteRune(c)
+	}
+}
+
+func (pr *PGNReader) readString(line int) (value string, err error) {
+	var sb strings.Builder
+	for {
+		var c rune
+		c, err = pr.readRune()
+		if err == io.EOF {
+			err = fmt.Errorf("Line %d: unterminated string\n", line)
+		}
+		if err != nil {
+			return
+		}
+		switch c {
+		case '"':
+			value = sb.String()
+			return
+		case '\\':
+			c, err = pr.readRune()
+			if err == io.EOF {
+				err = fmt.Errorf("Line %d: unterminated string\n", line)
+			}
+			if err != nil {
+				return
+			}
+		}
+		sb.WriteRune(c)
+	}
+}
+
+// Read returns the next game in the input, or io.EOF once there are no
+// more games. After an error the reader skips to the next game, so one
+// broken game does not stop the rest of a database being read.
+func (pr *PGNReader) Read() (game *PGNGame, err error) {
+	defer func() {
+		if err != nil && err != io.EOF {
+			pr.skipGame()
+		}
+	}()
+
+	tok, err := pr.token()
+	if err != nil {
+		return
+	}
+	if tok.Type == pgnEOF {
+		err = io.EOF
+		return
+	}
+
+	game = &PGNGame{Root: &PGNNode{}, Result: Unknown, Line: tok.Line}
+	for tok.Type == pgnOpenBracket {
+		var tag PGNTag
+		tag, err = pr.readTag(tok.Line)
+		if err != nil {
+			return
+		}
+		game.Tags = append(game.Tags, tag)
+		tok, err = pr.token()
+		if err != nil {
+			return
+		}
+	}
+	pr.peeked = &tok
+
+	err = pr.readMovetext(game)
+	return
+}
+
+// skipGame discards input up to the next tag section that follows a blank
+// line.
+func (pr *PGNReader) skipGame() {
+	if pr.peeked != nil && pr.peeked.Type == pgnOpenBracket {
+		return
+	}
+	pr.peeked = nil
+	blank := false
+	for {
+		if pr.atLineStart {
+			next, err := pr.r.Peek(1)
+			if err != nil {
+				return
+			}
+			if blank && next[0] == '[' {
+				return
+			}
+			blank = next[0] == '\n' || next[0] == '\r'
+		}
+		if _, found, err := pr.readUntil('\n'); err != nil || !found {
+			return
+		}
+	}
+}
+
+func (pr *PGNReader) readTag(line int) (tag PGNTag, err error) {
+	name, err := pr.token()
+	if err != nil {
+		return
+	}
+	value, err := pr.token()
+	if err != nil {
+		return
+	}
+	end, err := pr.token()
+	if err != nil {
+		return
+	}
+	if name.Type != pgnSymbol || value.Type != pgnString || end.Type != pgnCloseBracket {
+		err = fmt.Errorf("Line %d: malformed tag\n", line)
+		return
+	}
+	tag = PGNTag{Name: name.Value, Value: value.Value}
+	return
+}
+
+func (pr *PGNReader) readMovetext(game *PGNGame) error {
+	current := game.Root
+	afterMove := false
+	// Comments before the first move of a line wait for that move
+	var pending []string
+	var variations []*PGNNode
+
+	finish := func() {
+		current.Comments = append(current.Comments, pending...)
+	}
+
+	for {
+		tok, err := pr.token()
+		if err != nil {
+			return err
+		}
+		switch tok.Type {
+		case pgnEOF:
+			if len(variations) > 0 {
+				return fmt.Errorf("Line %d: unterminated variation\n", tok.Line)
+			}
+			finish()
+			return nil
+		case pgnOpenBracket:
+			// The next game started without a termination marker
+			pr.peeked = &tok
+			if len(variations) > 0 {
+				return fmt.Errorf("Line %d: unterminated variation\n", tok.Line)
+			}
+			finish()
+			return nil
+		case pgnPeriod:
+		case pgnNAG:
+			nag, err := strconv.Atoi(tok.Value)
+			if err != nil {
+				return fmt.Errorf("Line %d: invalid NAG $%s\n", tok.Line, tok.Value)
+			}
+			current.NAGs = append(current.NAGs, nag)
+		case pgnComment:
+			if afterMove {
+				current.addComment(tok.Value)
+			} else {
+				pending = append(pending, tok.Value)
+			}
+		case pgnOpenVariation:
+			if current == game.Root || !afterMove {
+				return fmt.Errorf("Line %d: variation without a move to replace\n", tok.Line)
+			}
+			variations = append(variations, current)
+			current = current.Parent
+			afterMove = false
+		case pgnCloseVariation:
+			if len(variations) == 0 {
+				return fmt.Errorf("Line %d: unexpected )\n", tok.Line)
+			}
+			finish()
+			pending = nil
+			current = variations[len(variations)-1]
+			variations = variations[:len(variations)-1]
+			afterMove = true
+		case pgnSymbol:
+			if result := GameResult(tok.Value); isGameResult(result) {
+				if len(variations) > 0 {
+					return fmt.Errorf("Line %d: unterminated variation\n", tok.Line)
+				}
+				game.Result = result
+				finish()
+				return nil
+			}
+			if isMoveNumber(tok.Value) {
+				continue
+			}
+			node := &PGNNode{Move: normalizeSAN(tok.Value), Line: tok.Line, Parent: current, PreComments: pending}
+			pending = nil
+			current.Children = append(current.Children, node)
+			current = node
+			afterMove = true
+		default:
+			return fmt.Errorf("Line %d: unexpected token %q in movetext\n", tok.Line, tok.Value)
+		}
+	}
+}
+
+func isGameResult(result GameResult) bool {
+	_, ok := IsValidGameResult[result]
+	return ok
+}
+
+func isMoveNumber(symbol string) bool {
+	for _, c := range symbol {
+		if !unicode.IsDigit(c) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeSAN accepts the zero castling some programs write
+func normalizeSAN(san string) string {
+	switch {
+	case strings.HasPrefix(san, "0-0-0"):
+		return longCastle + san[len("0-0-0"):]
+	case strings.HasPrefix(san, "0-0"):
+		return shortCastle + san[len("0-0"):]
+	}
+	return san
+}
+
+// addComment keeps the clock and evaluation commands of a comment on the
+// node and the rest of the text as a comment.
+func (n *PGNNode) addComment(comment string) {
+	comment = commandRE.ReplaceAllStringFunc(comment, func(command string) string {
+		match := commandRE.FindStringSubmatch(command)
+		switch match[1] {
+		case "clk":
+			if centis, err := parseClock(match[2]); err == nil {
+				n.Clock = &centis
+				return ""
+			}
+		case "eval":
+			if a, err := parseEval(match[2]); err == nil {
+				n.Eval = &a
+				return ""
+			}
+		}
+		return command
+	})
+	if comment = strings.TrimSpace(comment); comment != "" {
+		n.Comments = append(n.Comments, comment)
+	}
+}
+
+// comments returns the node's comments with its evaluation and clock
+// written in front of the first one.
+func (n *PGNNode) comments() []string {
+	var commands []string
+	if n.Eval != nil {
+		if eval := n.Eval.PGNEval(); eval != "" {
+			commands = append(commands, fmt.Sprintf("[%%eval %s]", eval))
+		}
+	}
+	if n.Clock != nil {
+		commands = append(commands, fmt.Sprintf("[%%clk %s]", formatClock(*n.Clock)))
+	}
+	if len(commands) == 0 {
+		return n.Comments
+	}
+	first := strings.Join(commands, " ")
+	if len(n.Comments) == 0 {
+		return []string{first}
+	}
+	return append([]string{first + " " + n.Comments[0]}, n.Comments[1:]...)
+}
+
+// AddVariation adds a line of moves below the node. The line becomes the
+// main line when the node has no children yet.
+func (n *PGNNode) AddVariation(moves []string) (last *PGNNode) {
+	last = n
+	for _, move := range moves {
+		child := &PGNNode{Move: move, Parent: last}
+		last.Children = append(last.Children, child)
+		last = child
+	}
+	return
+}
+
+// Mainline returns the moves of the main line below the node
+func (n *PGNNode) Mainline() (moves []string) {
+	for _, node := range n.MainlineNodes() {
+		moves = append(moves, node.Move)
+	}
+	return
+}
+
+// MainlineNodes returns the nodes of the main line below the node
+func (n *PGNNode) MainlineNodes() (nodes []*PGNNode) {
+	for node := n; len(node.Children) > 0; {
+		node = node.Children[0]
+		nodes = append(nodes, node)
+	}
+	return
+}
+
+// Tag returns the value of the named tag
+func (g *PGNGame) Tag(name string) (value string, ok bool) {
+	for _, tag := range g.Tags {
+		if tag.Name == name {
+			return tag.Value, true
+		}
+	}
+	return
+}
+
+// startingPly counts the half moves played before the first move of a
+// game starting from fen, so move numbers continue from a set up position.
+func startingPly(fen string) int {
+	fields := strings.Fields(fen)
+	if len(fields) < 6 {
+		return 0
+	}
+	fullmove, err := strconv.Atoi(fields[len(fields)-1])
+	if err != nil || fullmove < 1 {
+		return 0
+	}
+	ply := (fullmove - 1) * 2
+	if fields[1] == "b" {
+		ply++
+	}
+	return ply
+}
+
+func escapePGNString(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s)
+}
+
+// String writes the game back out as PGN
+func (g *PGNGame) String() string {
+	var sb strings.Builder
+	writePGNTags(&sb, g.Tags)
+	if len(g.Tags) > 0 {
+		sb.WriteString("\n")
+	}
+
+	fen, _ := g.Tag("FEN")
+	sb.WriteString(wrapMovetext(movetext(g.Root, startingPly(fen), g.Result)))
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// maxLineLength is the longest line written in export format
+const maxLineLength = 80
+
+// wrapMovetext joins the parts of movetext into lines of at most
+// maxLineLength characters. Comments may break between words, but a move
+// stays with its number.
+func wrapMovetext(parts []string) string {
+	var words []string
+	for _, part := range parts {
+		if strings.HasPrefix(part, "{") || strings.HasPrefix(part, "({") {
+			words = append(words, strings.Split(part, " ")...)
+		} else {
+			words = append(words, part)
+		}
+	}
+
+	var sb strings.Builder
+	lineLength := 0
+	for i, word := range words {
+		switch {
+		case i == 0:
+		case lineLength+1+len(word) > maxLineLength:
+			sb.WriteString("\n")
+			lineLength = 0
+		default:
+			sb.WriteString(" ")
+			lineLength++
+		}
+		sb.WriteString(word)
+		lineLength += len(word)
+	}
+	return sb.String()
+}
+
+// movetext lists the moves below root followed by the result
+func movetext(root *PGNNode, ply int, result GameResult) []string {
+	var parts []string
+	for _, comment := range root.Comments {
+		parts = append(parts, "{ "+comment+" }")
+	}
+	if len(root.Children) > 0 {
+		parts = writePGNLine(parts, root.Children[0], ply)
+	}
+	parts = append(parts, string(result))
+	return parts
+}
+
+// writePGNLine appends the node and the rest of its line, with the
+// variations of every move on the line in brackets after it.
+func writePGNLine(parts []string, node *PGNNode, ply int) []string {
+	needNumber := true
+	for ; node != nil; ply++ {
+		for _, comment := range node.PreComments {
+			parts = append(parts, "{ "+comment+" }")
+		}
+		if ply%2 == 0 {
+			parts = append(parts, fmt.Sprintf("%d. %s", ply/2+1, node.Move))
+		} else if needNumber || len(node.PreComments) > 0 {
+			parts = append(parts, fmt.Sprintf("%d... %s", ply/2+1, node.Move))
+		} else {
+			parts = append(parts, node.Move)
+		}
+		for _, nag := range node.NAGs {
+			parts = append(parts, fmt.Sprintf("$%d", nag))
+		}
+		comments := node.comments()
+		for _, comment := range comments {
+			parts = append(parts, "{ "+comment+" }")
+		}
+		needNumber = len(comments) > 0
+
+		if siblings := node.Parent.Children; siblings[0] == node {
+			for _, variation := range siblings[1:] {
+				line := writePGNLine(nil, variation, ply)
+				line[0] = "(" + line[0]
+				line[len(line)-1] += ")"
+				parts = append(parts, line...)
+				needNumber = true
+			}
+		}
+
+		if len(node.Children) == 0 {
+			break
+		}
+		node = node.Children[0]
+	}
+	return parts
+}
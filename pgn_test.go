@@ -0,0 +1,289 @@
+package main
+
+import (
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestPGNRoundTrip(T *testing.T) {
+	tests := []struct {
+		Name     string
+		Input    string
+		Expected string
+	}{
+		{
+			Name: "lichess export",
+			Input: `[Event "Rated Blitz game"]
+[Site "https://lichess.org/abcdefgh"]
+[Date "2024.03.05"]
+[White "alice"]
+[Black "bob"]
+[Result "1-0"]
+[TimeControl "300+3"]
+
+1. e4 { [%clk 0:05:00] } 1... e5 { [%clk 0:05:00] } 2. Nf3 { [%clk 0:04:58] }
+2... Nc6 { [%clk 0:04:57] } 3. Bb5 { [%clk 0:04:55] } 1-0
+`,
+		},
+		{
+			Name: "import format",
+			Input: `% exported by another program
+[Event "Club \"Open\" 2024"]
+[Site	"Utrecht"]
+[Result "1/2-1/2"]
+
+1.e4 e5 2.Nf3 Nc6!? {The main line} (2...d6 3.d4 (3.Bc4) exd4) 3.Bb5 $1 a6 ; Morphy
+4.Ba4	Nf6 5.0-0 1/2-1/2
+`,
+			Expected: `[Event "Club \"Open\" 2024"]
+[Site "Utrecht"]
+[Result "1/2-1/2"]
+
+1. e4 e5 2. Nf3 Nc6 $5 { The main line } (2... d6 3. d4 (3. Bc4) 3... exd4)
+3. Bb5 $1 a6 { Morphy } 4. Ba4 Nf6 5. O-O 1/2-1/2
+`,
+		},
+		{
+			Name: "set up position",
+			Input: `[FEN "4k3/8/8/8/8/8/8/4K2R b K - 3 12"]
+
+12... Kd7 13. O-O+ *
+`,
+		},
+		{
+			Name: "crazyhouse drops",
+			Input: `[Variant "Crazyhouse"]
+
+1. e4 d5 2. exd5 Qxd5 3. Nc3 Qd8 4. P@d5 P@e4 5. Nxe4 Qxd5 6. P@c6 P@f3 *
+`,
+		},
+		{
+			Name: "annotated output",
+			Input: `[Result "*"]
+
+1. e4 { 1. e4 e5 2. Nf3 } 1... e5 { Draw could be claimed by threefold
+repetition } *
+`,
+		},
+	}
+
+	for _, test := range tests {
+		game, err := NewPGNReader(strings.NewReader(test.Input)).Read()
+		if err != nil {
+			T.Errorf("%s: unexpected error: %s\n", test.Name, err.Error())
+			continue
+		}
+		expected := test.Expected
+		if expected == "" {
+			expected = test.Input
+		}
+		output := game.String()
+		if output != expected {
+			T.Errorf("%s: output\n%s\ndoes not match expected:\n%s\n", test.Name, output, expected)
+		}
+		again, err := NewPGNReader(strings.NewReader(output)).Read()
+		if err != nil {
+			T.Errorf("%s: unable to read output back: %s\n", test.Name, err.Error())
+			continue
+		}
+		if again.String() != output {
+			T.Errorf("%s: output changed when read back\n", test.Name)
+		}
+	}
+}
+
+func TestPGNReaderErrors(T *testing.T) {
+	tests := []string{
+		"1. e4 { never closed",
+		"1. e4 e5 (1... c5 2. Nf3 *",
+		"1. e4 e5) *",
+		"[Event Casual]\n\n1. e4 *",
+		"[Event \"unterminated]\n",
+		"(1. e4) *",
+		"1. e4 ?!? *",
+	}
+
+	for _, input := range tests {
+		if _, err := NewPGNReader(strings.NewReader(input)).Read(); err == nil {
+			T.Errorf("Expected an error reading %q\n", input)
+		}
+	}
+}
+
+func TestPGNReaderGames(T *testing.T) {
+	input := `[Event "One"]
+
+1. d4 d5 1/2-1/2
+
+[Event "Two"]
+
+1. e4 c5 (1... e5) 2. Nf3
+
+[Event "Three"]
+`
+	reader := NewPGNReader(strings.NewReader(input))
+	var events []string
+	var starts []int
+	var mainlines [][]string
+	for {
+		game, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			T.Fatalf("Unexpected error: %s\n", err.Error())
+		}
+		event, _ := game.Tag("Event")
+		events = append(events, event)
+		starts = append(starts, game.Line)
+		mainlines = append(mainlines, game.Root.Mainline())
+	}
+
+	if !slices.Equal(events, []string{"One", "Two", "Three"}) {
+		T.Errorf("Events %v do not match expected\n", events)
+	}
+	if !slices.Equal(starts, []int{1, 5, 9}) {
+		T.Errorf("Games start on lines %v, expected [1 5 9]\n", starts)
+	}
+	if len(mainlines) == 3 && !slices.Equal(mainlines[1], []string{"e4", "c5", "Nf3"}) {
+		T.Errorf("Main line %v does not match expected\n", mainlines[1])
+	}
+}
+
+func TestPGNReaderSkipsBrokenGame(T *testing.T) {
+	input := `[Event "One"]
+
+1. d4 d5 *
+
+[Event "Broken"]
+
+1. e4 (1. d4 2. Nf3 *
+
+[Event "Three"]
+
+1. c4 *
+`
+	reader := NewPGNReader(strings.NewReader(input))
+	var events []string
+	var errs int
+	for {
+		game, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			errs++
+			continue
+		}
+		event, _ := game.Tag("Event")
+		events = append(events, event)
+	}
+
+	if errs != 1 || !slices.Equal(events, []string{"One", "Three"}) {
+		T.Errorf("Read %v with %d errors, expected [One Three] with 1 error\n", events, errs)
+	}
+}
+
+func TestGameFromPGN(T *testing.T) {
+	input := `[Event "Rated Blitz game"]
+[White "alice"]
+[Black "bob"]
+[WhiteElo "1500"]
+[TimeControl "300+3"]
+
+1. e4 e5 (1... c5) 2. Qh5 Nc6 3. Bc4 Nf6?? 4. Qxf7# 1-0
+`
+	game, err := GameFromPGN([]byte(input))
+	if err != nil {
+		T.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	if game.Moves != "e4 e5 Qh5 Nc6 Bc4 Nf6 Qxf7#" {
+		T.Errorf("Moves %s do not match expected\n", game.Moves)
+	}
+	if game.Winner != "white" || !game.Rated || game.Speed != "blitz" {
+		T.Errorf("Winner %s, rated %v and speed %s do not match expected\n", game.Winner, game.Rated, game.Speed)
+	}
+	if game.Players.White.User.Name != "alice" || game.Players.White.Rating != 1500 || game.Clock.Increment != 3 {
+		T.Errorf("Players and clock do not match expected: %+v %+v\n", game.Players, game.Clock)
+	}
+}
+
+func TestMoveTree(T *testing.T) {
+	input := `1. e4 { [%eval 0.18] [%clk 0:05:00] } 1... e5 { [%clk 0:04:59] [%csl Gd4] A classical reply } 2. Nf3 *`
+	game, err := NewPGNReader(strings.NewReader(input)).Read()
+	if err != nil {
+		T.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	nodes := game.Root.MainlineNodes()
+	if len(nodes) != 3 {
+		T.Fatalf("Main line has %d moves, expected 3\n", len(nodes))
+	}
+	if nodes[0].Clock == nil || *nodes[0].Clock != 30000 || nodes[0].Eval == nil || *nodes[0].Eval.Eval != 18 || len(nodes[0].Comments) != 0 {
+		T.Errorf("First move does not hold the clock and evaluation: %+v\n", nodes[0])
+	}
+	if !slices.Equal(nodes[1].Comments, []string{"[%csl Gd4] A classical reply"}) {
+		T.Errorf("Comments %v do not match expected\n", nodes[1].Comments)
+	}
+
+	// An engine line replacing 2. Nf3
+	last := nodes[1].AddVariation([]string{"Nc3", "Nf6"})
+	last.Comments = append(last.Comments, "Vienna")
+	expected := `1. e4 { [%eval 0.18] [%clk 0:05:00] } 1... e5 { [%clk 0:04:59] [%csl Gd4] A
+classical reply } 2. Nf3 (2. Nc3 Nf6 { Vienna }) *
+`
+	if output := game.String(); output != expected {
+		T.Errorf("Output\n%s\ndoes not match expected:\n%s\n", output, expected)
+	}
+}
+
+func TestValidatePGN(T *testing.T) {
+	input := `[Event "Legal"]
+
+1. e4 e5 (1... c5 2. Nf3) 2. Nf3 Nc6 1-0
+
+[Event "Illegal variation"]
+
+1. e4 e5 2. Nf3 Nc6
+3. Bb5 Ke7 4. Bxc6 (4. Qe2 Qxh2) 4... Nf6 *
+
+[Event "Broken"]
+
+1. e4 (1. d4 *
+
+[Event "Set up"]
+[FEN "4k3/8/8/8/8/8/8/4K2R b K - 3 12"]
+
+12... Kd7 13. O-O-O *
+
+[Event "Crazyhouse"]
+[Variant "Crazyhouse"]
+
+1. e4 d5 2. exd5 Qxd5 3. Nc3 Qd8 4. P@d5 P@e4 5. Nxe4 Qxd5 6. P@c6 P@f3 *
+`
+	expected := []struct {
+		Line int
+		Ply  int
+		Move string
+		FEN  string
+	}{
+		{8, 8, "Qxh2", "r1bq1bnr/ppppkppp/2n5/1B2p3/4P3/5N2/PPPPQPPP/RNB1K2R b KQ - 5 4"},
+		{0, 0, "", ""},
+		{17, 25, "O-O-O", "8/3k4/8/8/8/8/8/4K2R w K - 4 13"},
+	}
+
+	errs := validatePGN("games.pgn", strings.NewReader(input))
+	if len(errs) != len(expected) {
+		T.Fatalf("Found %d problems, expected %d: %v\n", len(errs), len(expected), errs)
+	}
+	for i, e := range errs {
+		want := expected[i]
+		if e.File != "games.pgn" || e.Line != want.Line || e.Ply != want.Ply || e.Move != want.Move || e.FEN != want.FEN {
+			T.Errorf("Problem %s does not match expected %+v\n", e.Error(), want)
+		}
+	}
+	if message := errs[2].Error(); !strings.HasPrefix(message, "games.pgn:17: ply 25 (13. O-O-O): ") {
+		T.Errorf("Message %q does not match expected\n", message)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os/exec"
 	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -27,11 +28,12 @@ type StockfishProc struct {
 	Moves    string
 }
 
-var extendedMoveRe *regexp.Regexp = regexp.MustCompile(`([a-h][1-8]){2}[qrbn]?`)
+// extendedMoveRe matches a UCI move, including the drops of crazyhouse
+var extendedMoveRe *regexp.Regexp = regexp.MustCompile(`^(([a-h][1-8]){2}[qrbnk]?|[PNBRQK]@[a-h][1-8])$`)
 
-func InitStockfish() (proc *StockfishProc, err error) {
+func InitStockfish(enginePath string) (proc *StockfishProc, err error) {
 	proc = &StockfishProc{
-		Cmd:      exec.CommandContext(context.Background(), "stockfish"),
+		Cmd:      exec.CommandContext(context.Background(), enginePath),
 		Ready:    make(chan bool),
 		Bestmove: make(chan string),
 		Info: struct {
@@ -62,6 +64,91 @@ func InitStockfish() (proc *StockfishProc, err error) {
 	return
 }
 
+// enginePool keeps an engine running for each variant while a file of
+// games is analyzed, rather than starting one for every game.
+type enginePool struct {
+	engine, variantEngine string
+	running               map[string]*StockfishProc
+}
+
+func newEnginePool(engine, variantEngine string) *enginePool {
+	return &enginePool{engine: engine, variantEngine: variantEngine, running: make(map[string]*StockfishProc)}
+}
+
+// get returns the engine for a variant, starting it the first time, and
+// tells it a new game begins.
+func (p *enginePool) get(variant Variant) (engine *StockfishProc, err error) {
+	engine, ok := p.running[variant.Key()]
+	if !ok {
+		engine, err = p.start(variant)
+		if err != nil {
+			return
+		}
+		p.running[variant.Key()] = engine
+	}
+	_, err = engine.Stdin.Write([]byte("ucinewgame\n"))
+	if err != nil {
+		// Start it again for the next game
+		delete(p.running, variant.Key())
+		err = fmt.Errorf("unable to send commands to the engine: %w", err)
+	}
+	return
+}
+
+func (p *enginePool) start(variant Variant) (engine *StockfishProc, err error) {
+	// Variants other than Chess960 need an engine that knows their rules
+	engineCommand := p.engine
+	if variant.UCIName() != "" {
+		engineCommand = p.variantEngine
+	}
+
+	engine, err = InitStockfish(engineCommand)
+	if err != nil {
+		err = fmt.Errorf("unable to start stockfish: %w", err)
+		return
+	}
+	go engine.ProcessOutput()
+	err = engine.Cmd.Start()
+	if err != nil {
+		err = fmt.Errorf("unable to start engine %s: %w", engineCommand, err)
+		return
+	}
+
+	_, err = engine.Stdin.Write([]byte("uci\n"))
+	if err != nil {
+		engine.Quit()
+		err = fmt.Errorf("unable to send commands to stockfish: %w", err)
+		return
+	}
+	<-engine.Ready
+
+	if variant.Key() == "chess960" {
+		err = engine.SetOption("UCI_Chess960", "true")
+		if err != nil {
+			engine.Quit()
+			err = fmt.Errorf("unable to enable Chess960: %w", err)
+			return
+		}
+	}
+	if uciName := variant.UCIName(); uciName != "" {
+		err = engine.SetOption("UCI_Variant", uciName)
+		if err != nil {
+			engine.Quit()
+			err = fmt.Errorf("unable to set variant %s: %w", uciName, err)
+			return
+		}
+	}
+	return
+}
+
+// Close stops every engine of the pool
+func (p *enginePool) Close() {
+	for key, engine := range p.running {
+		engine.Quit()
+		delete(p.running, key)
+	}
+}
+
 func (sp *StockfishProc) SetupGame(fen string) (err error) {
 	var command string
 	if fen == standardStartingFEN {
@@ -79,6 +166,22 @@ func (sp *StockfishProc) SetupGame(fen string) (err error) {
 	return
 }
 
+func (sp *StockfishProc) SetOption(name, value string) (err error) {
+	command := fmt.Sprintf("setoption name %s value %s\n", name, value)
+	_, err = sp.Stdin.Write([]byte(command))
+	return
+}
+
+// Quit asks the engine to exit and waits for it to do so
+func (sp *StockfishProc) Quit() (err error) {
+	_, err = sp.Stdin.Write([]byte("quit\n"))
+	if err != nil {
+		return
+	}
+	err = sp.Cmd.Wait()
+	return
+}
+
 func (sp *StockfishProc) IsReady() (err error) {
 	_, err = sp.Stdin.Write([]byte("isready\n"))
 	return
@@ -139,12 +242,40 @@ func (sp *StockfishProc) ProcessOutput() {
 	}
 }
 
-func GetPVMoves(PV []string) (moves []string, err error) {
-	for i, token := range PV {
-		if extendedMoveRe.MatchString(token) {
-			moves = PV[i:]
+// GetPVMoves returns the moves of an info line, which follow pv
+func GetPVMoves(info []string) (moves []string, err error) {
+	i := slices.Index(info, "pv")
+	if i < 0 {
+		return
+	}
+	for _, token := range info[i+1:] {
+		if !extendedMoveRe.MatchString(token) {
 			break
 		}
+		moves = append(moves, token)
+	}
+	return
+}
+
+// GetScore reads the score of an info line from white's point of view.
+// Engines score from the side to move, which is given as turn.
+func GetScore(info []string, turn PlayerColor) (score *MoveAnalysis) {
+	i := slices.Index(info, "score")
+	if i < 0 || i+2 >= len(info) {
+		return
+	}
+	value, err := strconv.Atoi(info[i+2])
+	if err != nil {
+		return
+	}
+	if turn == Black {
+		value = -value
+	}
+	switch info[i+1] {
+	case "cp":
+		score = &MoveAnalysis{Eval: &value}
+	case "mate":
+		score = &MoveAnalysis{Mate: &value}
 	}
 	return
 }
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxChapterName is the longest chapter name lichess accepts
+const maxChapterName = 100
+
+// handlerPush imports the analyzed games of each folder of the engine
+// directory into the configured study. Games already in the study, found
+// by their chapter name, are left alone, so pushing again only adds the
+// games analyzed since.
+func (s *state) handlerPush(folders []string) error {
+	if s.Config.Study == "" {
+		return errors.New("No study configured to push games to")
+	}
+	chapters, err := s.studyChapters(s.Config.Study)
+	if err != nil {
+		return fmt.Errorf("unable to read study %s: %w", s.Config.Study, err)
+	}
+
+	pushed := 0
+	for _, folder := range folders {
+		engineGames := filepath.Join(s.Config.EngineDirectory, folder)
+		files, err := os.ReadDir(engineGames)
+		if err != nil {
+			log.Printf("Unable to read engine directory: %v\n", err)
+			return err
+		}
+		for _, file := range files {
+			if file.IsDir() || strings.ToLower(filepath.Ext(file.Name())) != ".pgn" {
+				continue
+			}
+			n, err := s.pushFile(filepath.Join(engineGames, file.Name()), folder, chapters)
+			pushed += n
+			if err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("Added %d chapters to study %s\n", pushed, s.Config.Study)
+	return nil
+}
+
+// pushFile imports each game of an analyzed file that is not in the study
+// yet, adding the chapters it creates to chapters.
+func (s *state) pushFile(gamePath, player string, chapters map[string]bool) (pushed int, err error) {
+	in, err := os.Open(gamePath)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	reader := NewPGNReader(in)
+	for {
+		pgnGame, readErr := reader.Read()
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			log.Printf("%s | Skipping game: %v\n", gamePath, readErr)
+			continue
+		}
+
+		name := chapterName(pgnGame)
+		if chapters[name] {
+			continue
+		}
+		err = s.importChapter(s.Config.Study, name, pgnGame, player)
+		if err != nil {
+			err = fmt.Errorf("unable to add %s to study %s: %w", name, s.Config.Study, err)
+			return
+		}
+		chapters[name] = true
+		pushed++
+	}
+}
+
+// chapterName names a game after its players, date and lichess ID, which
+// also identifies it in the study on later runs.
+func chapterName(g *PGNGame) string {
+	white, _ := g.Tag("White")
+	black, _ := g.Tag("Black")
+	name := fmt.Sprintf("%s - %s", white, black)
+	if date, ok := g.Tag("UTCDate"); ok {
+		name += ", " + date
+	} else if date, ok := g.Tag("Date"); ok && date != "????.??.??" {
+		name += ", " + date
+	}
+	if id, ok := g.Tag("GameId"); ok {
+		name += " (" + id + ")"
+	}
+	if runes := []rune(name); len(runes) > maxChapterName {
+		name = string(runes[:maxChapterName])
+	}
+	return name
+}
+
+// studyChapters returns the names of the chapters of a study
+func (s *state) studyChapters(studyID string) (chapters map[string]bool, err error) {
+	req, err := s.Lichess.NewRequest(context.Background(), http.MethodGet, fmt.Sprintf("/api/study/%s.pgn", url.PathEscape(studyID)), nil, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Accept", "application/x-chess-pgn")
+	res, err := s.Lichess.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+
+	chapters = make(map[string]bool)
+	reader := NewPGNReader(res.Body)
+	for {
+		pgnGame, readErr := reader.Read()
+		if readErr == io.EOF {
+			return
+		}
+		if readErr != nil {
+			log.Printf("Study %s | Skipping chapter: %v\n", studyID, readErr)
+			continue
+		}
+		if name, ok := pgnGame.Tag("ChapterName"); ok {
+			chapters[name] = true
+		} else if event, ok := pgnGame.Tag("Event"); ok {
+			// Older exports only name the chapter in the event
+			if _, name, found := strings.Cut(event, ": "); found {
+				chapters[name] = true
+			}
+		}
+	}
+}
+
+// importChapter adds a game to the study as a new chapter, shown from the
+// side of player when they played the game.
+func (s *state) importChapter(studyID, name string, g *PGNGame, player string) error {
+	form := url.Values{}
+	form.Set("name", name)
+	form.Set("pgn", g.String())
+	if black, _ := g.Tag("Black"); strings.EqualFold(black, player) {
+		form.Set("orientation", "black")
+	} else {
+		form.Set("orientation", "white")
+	}
+	if variantName, ok := g.Tag("Variant"); ok {
+		if v, found := LookupVariantPGNName(variantName); found {
+			form.Set("variant", v.Key())
+		}
+	}
+
+	req, err := s.Lichess.NewRequest(context.Background(), http.MethodPost, fmt.Sprintf("/api/study/%s/import-pgn", url.PathEscape(studyID)), nil, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := s.Lichess.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	log.Printf("Added %s to study %s\n", name, studyID)
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ValidationError is a game or move that could not be replayed
+type ValidationError struct {
+	File string
+	Line int
+	// Ply is the half move of the game the error is on, counted from one,
+	// or zero when the game itself could not be read.
+	Ply  int
+	Move string
+	FEN  string
+	Err  error
+}
+
+func (e ValidationError) Error() string {
+	if e.Line == 0 {
+		return fmt.Sprintf("%s: %v", e.File, strings.TrimSpace(e.Err.Error()))
+	}
+	if e.Ply == 0 {
+		return fmt.Sprintf("%s:%d: %v", e.File, e.Line, strings.TrimSpace(e.Err.Error()))
+	}
+	number := fmt.Sprintf("%d.", (e.Ply+1)/2)
+	if e.Ply%2 == 0 {
+		number = fmt.Sprintf("%d...", e.Ply/2)
+	}
+	return fmt.Sprintf("%s:%d: ply %d (%s %s): %v [FEN %s]",
+		e.File, e.Line, e.Ply, number, e.Move, strings.TrimSpace(e.Err.Error()), e.FEN)
+}
+
+// handlerValidate replays every PGN file in the game and engine directories
+// and reports each problem found. It returns how many there were.
+func (s *state) handlerValidate() (problems int, err error) {
+	for _, dir := range []string{s.Config.GameDirectory, s.Config.EngineDirectory} {
+		if dir == "" {
+			continue
+		}
+		err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || strings.ToLower(filepath.Ext(path)) != ".pgn" {
+				return nil
+			}
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer file.Close()
+
+			for _, e := range validatePGN(path, file) {
+				fmt.Println(e.Error())
+				problems++
+			}
+			return nil
+		})
+		if err != nil {
+			log.Printf("Unable to validate %s: %v\n", dir, err)
+			return
+		}
+	}
+	return
+}
+
+// validatePGN replays every game read from r, including its variations,
+// and returns the games and moves that could not be replayed.
+func validatePGN(fileName string, r io.Reader) (errs []ValidationError) {
+	reader := NewPGNReader(r)
+	for {
+		pgnGame, err := reader.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// Read errors name the line they were found on
+			errs = append(errs, ValidationError{File: fileName, Err: err})
+			continue
+		}
+
+		game := pgnGame.ToGame()
+		variant, found := LookupVariant(game.Variant)
+		if !found {
+			errs = append(errs, ValidationError{File: fileName, Line: pgnGame.Line, Err: fmt.Errorf("variant %q is not supported", game.Variant)})
+			continue
+		}
+		fen := game.InitalFEN
+		if fen == "" {
+			fen = variant.StartingFEN()
+		}
+		gs, err := NewVariantGameState(variant, fen)
+		if err != nil {
+			errs = append(errs, ValidationError{File: fileName, Line: pgnGame.Line, Err: fmt.Errorf("unable to parse FEN %s: %w", fen, err)})
+			continue
+		}
+		errs = append(errs, validateLine(fileName, gs, pgnGame.Root, startingPly(fen))...)
+	}
+}
+
+// validateLine replays the moves below node from gs. A line stops at its
+// first bad move, since nothing after it can be replayed.
+func validateLine(fileName string, gs *GameState, node *PGNNode, ply int) (errs []ValidationError) {
+	for len(node.Children) > 0 {
+		for _, variation := range node.Children[1:] {
+			errs = append(errs, validateLine(fileName, gs, &PGNNode{Children: []*PGNNode{variation}}, ply)...)
+		}
+		node = node.Children[0]
+		ply++
+
+		next, _, err := gs.ApplyAndTranslateMove(node.Move, gs.PlayerTurn)
+		if err != nil {
+			errs = append(errs, ValidationError{
+				File: fileName,
+				Line: node.Line,
+				Ply:  ply,
+				Move: node.Move,
+				FEN:  gs.FEN(),
+				Err:  err,
+			})
+			return
+		}
+		gs = next
+	}
+	return
+}
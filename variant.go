@@ -0,0 +1,556 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Variant holds the rules that differ between the games lichess offers.
+// Every variant embeds standardRules and only overrides what it changes.
+type Variant interface {
+	// Key is the variant name used by the lichess API, e.g. "kingOfTheHill"
+	Key() string
+	// PGNName is the value of the PGN Variant tag
+	PGNName() string
+	// UCIName is the UCI_Variant of the variant engine, empty when the
+	// standard engine is used
+	UCIName() string
+	StartingFEN() string
+	InCheck(gs *GameState, color PlayerColor) bool
+	// IsLegal decides whether move, which turned before into after, may be
+	// played
+	IsLegal(before, after *GameState, move *Move) bool
+	// FilterMoves narrows the legal moves, e.g. for compulsory captures
+	FilterMoves(gs *GameState, moves []string) []string
+	// ExtraMoves are candidate moves not made by a piece on the board
+	ExtraMoves(gs *GameState) []string
+	PromotionPieces() []PieceType
+	PawnStartRanks(color PlayerColor) []rune
+	// AfterMove applies side effects of a move to the new state
+	AfterMove(before, after *GameState, move *Move, sourceSquare string)
+	// Outcome reports a win or draw specific to the variant, or Unknown
+	Outcome(gs *GameState) GameResult
+	// DeadPosition reports positions neither side can win from by any
+	// sequence of legal moves
+	DeadPosition(gs *GameState) bool
+	// StalemateDraws reports whether a player without a legal move draws
+	StalemateDraws() bool
+}
+
+var standardVariant = standardRules{key: "standard", pgnName: "Standard"}
+
+var variants = []Variant{
+	standardVariant,
+	standardRules{key: "chess960", pgnName: "Chess960"},
+	standardRules{key: "fromPosition", pgnName: "From Position"},
+	crazyhouseRules{standardRules{key: "crazyhouse", pgnName: "Crazyhouse", uciName: "crazyhouse",
+		startingFEN: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR[] w KQkq - 0 1"}},
+	threeCheckRules{standardRules{key: "threeCheck", pgnName: "Three-check", uciName: "3check",
+		startingFEN: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w KQkq - 3+3 0 1"}},
+	kingOfTheHillRules{standardRules{key: "kingOfTheHill", pgnName: "King of the Hill", uciName: "kingofthehill"}},
+	atomicRules{standardRules{key: "atomic", pgnName: "Atomic", uciName: "atomic"}},
+	antichessRules{standardRules{key: "antichess", pgnName: "Antichess", uciName: "antichess",
+		startingFEN: "rnbqkbnr/pppppppp/8/8/8/8/PPPPPPPP/RNBQKBNR w - - 0 1"}},
+	hordeRules{standardRules{key: "horde", pgnName: "Horde", uciName: "horde",
+		startingFEN: "rnbqkbnr/pppppppp/8/1PP2PP1/PPPPPPPP/PPPPPPPP/PPPPPPPP/PPPPPPPP w kq - 0 1"}},
+	racingKingsRules{standardRules{key: "racingKings", pgnName: "Racing Kings", uciName: "racingkings",
+		startingFEN: "8/8/8/8/8/8/krbnNBRK/qrbnNBRQ w - - 0 1"}},
+}
+
+// LookupVariant finds a variant by its lichess key. Games without a variant
+// are standard chess.
+func LookupVariant(key string) (Variant, bool) {
+	if key == "" {
+		return standardVariant, true
+	}
+	for _, v := range variants {
+		if v.Key() == key {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func LookupVariantPGNName(name string) (Variant, bool) {
+	for _, v := range variants {
+		if strings.EqualFold(v.PGNName(), strings.TrimSpace(name)) {
+			return v, true
+		}
+	}
+	return nil, false
+}
+
+func (gs *GameState) rules() Variant {
+	if gs.Variant == nil {
+		return standardVariant
+	}
+	return gs.Variant
+}
+
+// NewVariantGameState reads a FEN with the extensions lichess uses for the
+// variant: a crazyhouse pocket with "~" marking promoted pieces, and the
+// remaining checks of three-check. An empty FEN is the variant's start.
+func NewVariantGameState(v Variant, fen string) (gs *GameState, err error) {
+	if strings.TrimSpace(fen) == "" {
+		fen = v.StartingFEN()
+	}
+	fields := strings.Fields(fen)
+	if len(fields) == 0 {
+		err = fmt.Errorf("Empty FEN string")
+		return
+	}
+
+	board := fields[0]
+	var pocket string
+	if i := strings.Index(board, "["); i >= 0 {
+		pocket = strings.TrimSuffix(board[i+1:], "]")
+		board = board[:i]
+	} else if strings.Count(board, "/") == 8 {
+		i := strings.LastIndex(board, "/")
+		pocket = board[i+1:]
+		board = board[:i]
+	}
+	board, promoted := stripPromotedMarkers(board)
+	fields[0] = board
+
+	var checks [2]int
+	if len(fields) == 7 {
+		// Lichess writes remaining checks as "3+3", others append the
+		// checks given as "+0+0"
+		if remaining := strings.Split(fields[4], "+"); len(remaining) == 2 {
+			white, whiteErr := strconv.Atoi(remaining[0])
+			black, blackErr := strconv.Atoi(remaining[1])
+			if whiteErr != nil || blackErr != nil {
+				err = fmt.Errorf("Invalid check count in FEN: %s", fields[4])
+				return
+			}
+			checks = [2]int{3 - white, 3 - black}
+			fields = slices.Delete(fields, 4, 5)
+		} else if given := strings.Split(fields[6], "+"); len(given) == 3 {
+			white, whiteErr := strconv.Atoi(given[1])
+			black, blackErr := strconv.Atoi(given[2])
+			if whiteErr != nil || blackErr != nil {
+				err = fmt.Errorf("Invalid check count in FEN: %s", fields[6])
+				return
+			}
+			checks = [2]int{white, black}
+			fields = fields[:6]
+		}
+	}
+
+	gs, err = NewGameState(strings.Join(fields, " "))
+	if err != nil {
+		return
+	}
+	gs.Variant = v
+	gs.Checks = checks
+	gs.Promoted = promoted
+	gs.Chess960 = gs.Chess960 || v.Key() == "chess960"
+	for _, ch := range pocket {
+		color := White
+		if strings.ToLower(string(ch)) == string(ch) {
+			color = Black
+		}
+		pieceType := PieceType(strings.ToUpper(string(ch)))
+		if pieceType == "P" {
+			pieceType = Pawn
+		}
+		if _, ok := IsValidPieceType[pieceType]; !ok || pieceType == King {
+			err = fmt.Errorf("Invalid piece in pocket: %c", ch)
+			return
+		}
+		gs.Pockets[color] = append(gs.Pockets[color], pieceType)
+	}
+	return
+}
+
+func stripPromotedMarkers(board string) (clean string, promoted []string) {
+	squareTracker := 0
+	for _, ch := range board {
+		switch {
+		case ch == '~':
+			if squareTracker > 0 {
+				promoted = append(promoted, fenBoardOrder[squareTracker-1])
+			}
+			continue
+		case ch >= '1' && ch <= '8':
+			squareTracker += int(ch - '0')
+		case ch != '/':
+			squareTracker++
+		}
+		clean += string(ch)
+	}
+	return
+}
+
+type standardRules struct {
+	key, pgnName, uciName, startingFEN string
+}
+
+func (r standardRules) Key() string     { return r.key }
+func (r standardRules) PGNName() string { return r.pgnName }
+func (r standardRules) UCIName() string { return r.uciName }
+
+func (r standardRules) StartingFEN() string {
+	if r.startingFEN == "" {
+		return standardStartingFEN
+	}
+	return r.startingFEN
+}
+
+func (r standardRules) InCheck(gs *GameState, color PlayerColor) bool {
+	kingSquare := gs.kingSquare(color)
+	if kingSquare == "" {
+		return false
+	}
+	return gs.isSquareAttacked(kingSquare, opponent(color))
+}
+
+func (r standardRules) IsLegal(before, after *GameState, move *Move) bool {
+	return !after.IsInCheck(before.PlayerTurn)
+}
+
+func (r standardRules) FilterMoves(gs *GameState, moves []string) []string { return moves }
+func (r standardRules) ExtraMoves(gs *GameState) []string                  { return nil }
+
+func (r standardRules) PromotionPieces() []PieceType {
+	return []PieceType{Queen, Rook, Bishop, Knight}
+}
+
+func (r standardRules) PawnStartRanks(color PlayerColor) []rune {
+	if color == Black {
+		return []rune{'7'}
+	}
+	return []rune{'2'}
+}
+
+func (r standardRules) AfterMove(before, after *GameState, move *Move, sourceSquare string) {}
+func (r standardRules) Outcome(gs *GameState) GameResult                                    { return Unknown }
+func (r standardRules) StalemateDraws() bool                                                { return true }
+
+// DeadPosition finds bare kings, a single minor piece, or only bishops that
+// all stand on squares of the same colour.
+func (r standardRules) DeadPosition(gs *GameState) bool {
+	var knights int
+	bishopSquareColors := make(map[int]struct{})
+	for s, p := range gs.Pieces {
+		switch p.PieceType {
+		case King:
+		case Knight:
+			knights++
+		case Bishop:
+			bishopSquareColors[int(s[0]+s[1])%2] = struct{}{}
+		default:
+			return false
+		}
+	}
+	if knights == 0 {
+		return len(bishopSquareColors) <= 1
+	}
+	return knights == 1 && len(bishopSquareColors) == 0
+}
+
+// onlyKings reports whether nothing but the kings is left on the board
+func onlyKings(gs *GameState) bool {
+	for _, p := range gs.Pieces {
+		if p.PieceType != King {
+			return false
+		}
+	}
+	return true
+}
+
+func winnerResult(color PlayerColor) GameResult {
+	if color == White {
+		return WhiteWins
+	}
+	return BlackWins
+}
+
+// Crazyhouse: captured pieces go to the capturer's pocket and can be dropped
+// back on the board. Promoted pieces return to the pocket as pawns.
+type crazyhouseRules struct{ standardRules }
+
+func (r crazyhouseRules) ExtraMoves(gs *GameState) (moves []string) {
+	seen := make(map[PieceType]struct{})
+	for _, pieceType := range gs.Pockets[gs.PlayerTurn] {
+		if _, ok := seen[pieceType]; ok {
+			continue
+		}
+		seen[pieceType] = struct{}{}
+		for _, sq := range fenBoardOrder {
+			if _, occupied := gs.Pieces[sq]; occupied {
+				continue
+			}
+			if pieceType == Pawn && (sq[1] == '1' || sq[1] == '8') {
+				continue
+			}
+			moves = append(moves, dropString(pieceType, sq))
+		}
+	}
+	return
+}
+
+func (r crazyhouseRules) AfterMove(before, after *GameState, move *Move, sourceSquare string) {
+	if move.IsDrop {
+		return
+	}
+	turn := before.PlayerTurn
+	if captured, ok := before.Pieces[move.Target]; ok && move.IsCapture {
+		pocketPiece := captured.PieceType
+		if slices.Contains(before.Promoted, move.Target) {
+			pocketPiece = Pawn
+		}
+		after.Pockets[turn] = append(after.Pockets[turn], pocketPiece)
+	} else if move.IsCapture && move.PieceType == Pawn {
+		after.Pockets[turn] = append(after.Pockets[turn], Pawn)
+	}
+
+	after.Promoted = slices.DeleteFunc(after.Promoted, func(sq string) bool {
+		return sq == move.Target
+	})
+	if i := slices.Index(after.Promoted, sourceSquare); i >= 0 {
+		after.Promoted[i] = move.Target
+	}
+	if move.PromoteTo != "" {
+		after.Promoted = append(after.Promoted, move.Target)
+	}
+}
+
+// DeadPosition finds bare kings with empty pockets, as any piece left could
+// be captured and dropped again.
+func (r crazyhouseRules) DeadPosition(gs *GameState) bool {
+	return onlyKings(gs) && len(gs.Pockets[White]) == 0 && len(gs.Pockets[Black]) == 0
+}
+
+func dropString(pieceType PieceType, square string) string {
+	letter := string(pieceType)
+	if pieceType == Pawn {
+		letter = "P"
+	}
+	return letter + "@" + square
+}
+
+// Three-check: giving a third check wins the game.
+type threeCheckRules struct{ standardRules }
+
+func (r threeCheckRules) AfterMove(before, after *GameState, move *Move, sourceSquare string) {
+	if after.IsInCheck(opponent(before.PlayerTurn)) {
+		after.Checks[before.PlayerTurn]++
+	}
+}
+
+// DeadPosition finds bare kings, as any other piece can give check
+func (r threeCheckRules) DeadPosition(gs *GameState) bool {
+	return onlyKings(gs)
+}
+
+func (r threeCheckRules) Outcome(gs *GameState) GameResult {
+	for _, color := range []PlayerColor{White, Black} {
+		if gs.Checks[color] >= 3 {
+			return winnerResult(color)
+		}
+	}
+	return Unknown
+}
+
+// King of the Hill: bringing the king to one of the four centre squares wins.
+type kingOfTheHillRules struct{ standardRules }
+
+// DeadPosition is never found, as a king can always walk to the centre
+func (r kingOfTheHillRules) DeadPosition(gs *GameState) bool { return false }
+
+func (r kingOfTheHillRules) Outcome(gs *GameState) GameResult {
+	for _, color := range []PlayerColor{White, Black} {
+		switch gs.kingSquare(color) {
+		case "d4", "e4", "d5", "e5":
+			return winnerResult(color)
+		}
+	}
+	return Unknown
+}
+
+// Atomic: a capture explodes the capturing piece and every piece other than
+// a pawn next to the capture square. Kings cannot capture, touching kings
+// cannot give check, and exploding the opponent's king wins.
+type atomicRules struct{ standardRules }
+
+func (r atomicRules) InCheck(gs *GameState, color PlayerColor) bool {
+	kingSquare := gs.kingSquare(color)
+	opponentKing := gs.kingSquare(opponent(color))
+	if kingSquare == "" || opponentKing == "" {
+		return false
+	}
+	if slices.Contains(neighbourSquares(kingSquare), opponentKing) {
+		return false
+	}
+	return gs.isSquareAttacked(kingSquare, opponent(color))
+}
+
+func (r atomicRules) IsLegal(before, after *GameState, move *Move) bool {
+	if move.PieceType == King && move.IsCapture {
+		return false
+	}
+	if after.kingSquare(before.PlayerTurn) == "" {
+		return false
+	}
+	if after.kingSquare(opponent(before.PlayerTurn)) == "" {
+		return true
+	}
+	return !r.InCheck(after, before.PlayerTurn)
+}
+
+func (r atomicRules) AfterMove(before, after *GameState, move *Move, sourceSquare string) {
+	if !move.IsCapture {
+		return
+	}
+	exploded := []string{move.Target}
+	for _, sq := range neighbourSquares(move.Target) {
+		if p, ok := after.Pieces[sq]; ok && p.PieceType != Pawn {
+			exploded = append(exploded, sq)
+		}
+	}
+	for _, sq := range exploded {
+		if p, ok := after.Pieces[sq]; ok && p.PieceType == King {
+			after.dropCastlingRights(p.PlayerColor)
+		}
+		delete(after.Pieces, sq)
+	}
+	after.updateCastlingRights(exploded...)
+}
+
+// DeadPosition finds bare kings, which cannot capture. A lone minor piece
+// can still win by capturing a king that walks next to it.
+func (r atomicRules) DeadPosition(gs *GameState) bool {
+	return onlyKings(gs)
+}
+
+func (r atomicRules) Outcome(gs *GameState) GameResult {
+	for _, color := range []PlayerColor{White, Black} {
+		if gs.kingSquare(color) == "" {
+			return winnerResult(opponent(color))
+		}
+	}
+	return Unknown
+}
+
+func neighbourSquares(square string) (squares []string) {
+	for _, df := range []int{-1, 0, 1} {
+		for _, dr := range []int{-1, 0, 1} {
+			if df == 0 && dr == 0 {
+				continue
+			}
+			sq := string(rune(int(square[0])+df)) + string(rune(int(square[1])+dr))
+			if squareRE.MatchString(sq) {
+				squares = append(squares, sq)
+			}
+		}
+	}
+	return
+}
+
+// Antichess: captures are compulsory, the king is an ordinary piece and the
+// player who loses all their pieces, or is stalemated, wins.
+type antichessRules struct{ standardRules }
+
+func (r antichessRules) InCheck(gs *GameState, color PlayerColor) bool { return false }
+
+func (r antichessRules) IsLegal(before, after *GameState, move *Move) bool { return true }
+
+func (r antichessRules) FilterMoves(gs *GameState, moves []string) []string {
+	var captures []string
+	for _, m := range moves {
+		if move, _, err := gs.extendedToMove(m); err == nil && move.IsCapture {
+			captures = append(captures, m)
+		}
+	}
+	if len(captures) > 0 {
+		return captures
+	}
+	return moves
+}
+
+func (r antichessRules) PromotionPieces() []PieceType {
+	return []PieceType{Queen, Rook, Bishop, Knight, King}
+}
+
+// DeadPosition is left to the players, as losing every piece wins and the
+// few material balances that cannot are not worth telling apart.
+func (r antichessRules) DeadPosition(gs *GameState) bool { return false }
+
+// StalemateDraws is false, as the stalemated player wins
+func (r antichessRules) StalemateDraws() bool { return false }
+
+func (r antichessRules) Outcome(gs *GameState) GameResult {
+	if len(gs.LegalMoves()) == 0 {
+		return winnerResult(gs.PlayerTurn)
+	}
+	return Unknown
+}
+
+// Horde: white's pawns may also advance two squares from the first rank and
+// black wins by capturing every white piece.
+type hordeRules struct{ standardRules }
+
+func (r hordeRules) PawnStartRanks(color PlayerColor) []rune {
+	if color == White {
+		return []rune{'1', '2'}
+	}
+	return []rune{'7'}
+}
+
+// AfterMove takes back the en passant square of a double step from the
+// first rank, which cannot be taken en passant.
+func (r hordeRules) AfterMove(before, after *GameState, move *Move, sourceSquare string) {
+	if move.PieceType == Pawn && sourceSquare[1] == '1' {
+		after.EnPassant = ""
+	}
+}
+
+// DeadPosition is left to the players, as black wins by capturing every
+// white piece whatever material is left.
+func (r hordeRules) DeadPosition(gs *GameState) bool { return false }
+
+func (r hordeRules) Outcome(gs *GameState) GameResult {
+	for _, p := range gs.Pieces {
+		if p.PlayerColor == White {
+			return Unknown
+		}
+	}
+	return BlackWins
+}
+
+// Racing Kings: no move may give check and the first king to reach the
+// eighth rank wins. Black gets a final move to draw by reaching it too.
+type racingKingsRules struct{ standardRules }
+
+func (r racingKingsRules) IsLegal(before, after *GameState, move *Move) bool {
+	return !after.IsInCheck(White) && !after.IsInCheck(Black)
+}
+
+// DeadPosition is never found, as the kings race whatever else is left
+func (r racingKingsRules) DeadPosition(gs *GameState) bool { return false }
+
+func (r racingKingsRules) Outcome(gs *GameState) GameResult {
+	whiteKing, blackKing := gs.kingSquare(White), gs.kingSquare(Black)
+	whiteHome := whiteKing != "" && whiteKing[1] == '8'
+	blackHome := blackKing != "" && blackKing[1] == '8'
+	switch {
+	case whiteHome && blackHome:
+		return Draw
+	case blackHome:
+		return BlackWins
+	case whiteHome:
+		if gs.PlayerTurn == Black {
+			for _, m := range gs.LegalMoves() {
+				if m[:2] == blackKing && m[3] == '8' {
+					return Unknown
+				}
+			}
+		}
+		return WhiteWins
+	}
+	return Unknown
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVariantPerft(T *testing.T) {
+	tests := []struct {
+		Variant string
+		Depth   int
+		Nodes   int
+	}{
+		{Variant: "horde", Depth: 3, Nodes: 1274},
+		{Variant: "racingKings", Depth: 2, Nodes: 421},
+		{Variant: "antichess", Depth: 3, Nodes: 8067},
+		{Variant: "crazyhouse", Depth: 2, Nodes: 400},
+	}
+
+	for _, test := range tests {
+		v, ok := LookupVariant(test.Variant)
+		if !ok {
+			T.Errorf("Variant %s not found\n", test.Variant)
+			continue
+		}
+		gs, err := NewVariantGameState(v, "")
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if nodes := perft(gs, test.Depth); nodes != test.Nodes {
+			T.Errorf("Perft(%d) of %s is %d, expected %d\n", test.Depth, test.Variant, nodes, test.Nodes)
+		}
+	}
+}
+
+func TestVariantOutcome(T *testing.T) {
+	tests := []struct {
+		Variant string
+		FEN     string
+		Moves   []string
+		FEN2    string
+		Result  GameResult
+	}{
+		{
+			// The rook explodes next to the black king
+			Variant: "atomic",
+			FEN:     "4k3/4q3/8/8/8/8/8/4RK2 w - - 0 1",
+			Moves:   []string{"Rxe7"},
+			FEN2:    "8/8/8/8/8/8/8/5K2 b - - 0 1",
+			Result:  WhiteWins,
+		},
+		{
+			Variant: "crazyhouse",
+			Moves:   []string{"e4", "d5", "exd5", "Qxd5", "P@e4"},
+			FEN2:    "rnb1kbnr/ppp1pppp/8/3q4/4P3/8/PPPP1PPP/RNBQKBNR[p] b KQkq - 0 3",
+			Result:  Unknown,
+		},
+		{
+			Variant: "threeCheck",
+			FEN:     "4k3/8/8/8/8/8/8/R3K3 w - - 1+3 0 1",
+			Moves:   []string{"Ra8+"},
+			FEN2:    "R3k3/8/8/8/8/8/8/4K3 b - - 0+3 1 1",
+			Result:  WhiteWins,
+		},
+		{
+			Variant: "kingOfTheHill",
+			FEN:     "4k3/8/8/8/8/4K3/8/8 w - - 0 1",
+			Moves:   []string{"Kd4"},
+			FEN2:    "4k3/8/8/8/3K4/8/8/8 b - - 1 1",
+			Result:  WhiteWins,
+		},
+		{
+			// Only a double step from the second rank can be taken en passant
+			Variant: "horde",
+			FEN:     "4k3/8/8/8/8/3p4/8/4P3 w - - 0 1",
+			Moves:   []string{"e3"},
+			FEN2:    "4k3/8/8/8/8/3pP3/8/8 b - - 0 1",
+			Result:  Unknown,
+		},
+		{
+			Variant: "horde",
+			FEN:     "4k3/8/8/8/3p4/8/4P3/8 w - - 0 1",
+			Moves:   []string{"e4"},
+			FEN2:    "4k3/8/8/8/3pP3/8/8/8 b - e3 0 1",
+			Result:  Unknown,
+		},
+		{
+			// Black can still reach the eighth rank
+			Variant: "racingKings",
+			FEN:     "7K/k7/8/8/8/8/8/8 b - - 0 1",
+			FEN2:    "7K/k7/8/8/8/8/8/8 b - - 0 1",
+			Result:  Unknown,
+		},
+		{
+			Variant: "racingKings",
+			FEN:     "7K/8/k7/8/8/8/8/8 b - - 0 1",
+			FEN2:    "7K/8/k7/8/8/8/8/8 b - - 0 1",
+			Result:  WhiteWins,
+		},
+		{
+			Variant: "horde",
+			FEN:     "4k3/8/8/8/8/8/3P4/8 b - - 0 1",
+			Moves:   []string{"Kd7"},
+			FEN2:    "8/3k4/8/8/8/8/3P4/8 w - - 1 2",
+			Result:  Unknown,
+		},
+		{
+			Variant: "horde",
+			FEN:     "4k3/8/8/8/8/8/8/8 w - - 0 1",
+			FEN2:    "4k3/8/8/8/8/8/8/8 w - - 0 1",
+			Result:  BlackWins,
+		},
+		{
+			Variant: "antichess",
+			FEN:     "8/8/8/8/8/8/8/7p w - - 0 1",
+			FEN2:    "8/8/8/8/8/8/8/7p w - - 0 1",
+			Result:  WhiteWins,
+		},
+	}
+
+	for _, test := range tests {
+		v, ok := LookupVariant(test.Variant)
+		if !ok {
+			T.Errorf("Variant %s not found\n", test.Variant)
+			continue
+		}
+		gs, err := NewVariantGameState(v, test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		for _, ms := range test.Moves {
+			gs, _, err = gs.ApplyAndTranslateMove(ms, gs.PlayerTurn)
+			if err != nil {
+				T.Errorf("%s: unable to apply %s: %s\n", test.Variant, ms, err.Error())
+				break
+			}
+		}
+		if err != nil {
+			continue
+		}
+		if fen := gs.FEN(); fen != test.FEN2 {
+			T.Errorf("%s: FEN %s does not match expected: %s\n", test.Variant, fen, test.FEN2)
+		}
+		if result := gs.rules().Outcome(gs); result != test.Result {
+			T.Errorf("%s: result %s does not match expected: %s\n", test.Variant, result, test.Result)
+		}
+	}
+}
+
+func TestVariantLegalMoves(T *testing.T) {
+	tests := []struct {
+		Variant string
+		FEN     string
+		Include []string
+		Exclude []string
+	}{
+		{
+			// Captures are compulsory
+			Variant: "antichess",
+			FEN:     "8/8/8/8/8/3p4/4P3/8 w - - 0 1",
+			Include: []string{"e2d3"},
+			Exclude: []string{"e2e3", "e2e4"},
+		},
+		{
+			// Pawns may promote to a king
+			Variant: "antichess",
+			FEN:     "8/4P3/8/8/8/8/8/k7 w - - 0 1",
+			Include: []string{"e7e8k", "e7e8q", "e7e8n"},
+			Exclude: []string{"e7e8"},
+		},
+		{
+			Variant: "standard",
+			FEN:     "8/4P3/8/8/8/8/8/k6K w - - 0 1",
+			Include: []string{"e7e8q"},
+			Exclude: []string{"e7e8k"},
+		},
+		{
+			// Moves may not give check
+			Variant: "racingKings",
+			FEN:     "8/8/8/8/8/8/k7/6RK w - - 0 1",
+			Include: []string{"g1g3"},
+			Exclude: []string{"g1a1", "g1g2"},
+		},
+		{
+			// Kings cannot capture and may stand next to each other
+			Variant: "atomic",
+			FEN:     "8/8/8/8/8/3k4/3p4/3K4 w - - 0 1",
+			Include: []string{"d1e2", "d1c2"},
+			Exclude: []string{"d1d2", "d1e1"},
+		},
+		{
+			Variant: "horde",
+			FEN:     "4k3/8/8/8/8/8/8/P7 w - - 0 1",
+			Include: []string{"a1a2", "a1a3"},
+		},
+		{
+			Variant: "crazyhouse",
+			FEN:     "4k3/8/8/8/8/8/8/4K3[Pn] w - - 0 1",
+			Include: []string{"P@e4"},
+			Exclude: []string{"P@e8", "P@a1", "N@c3"},
+		},
+	}
+
+	for _, test := range tests {
+		v, _ := LookupVariant(test.Variant)
+		gs, err := NewVariantGameState(v, test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		moves := gs.LegalMoves()
+		for _, m := range test.Include {
+			if !slices.Contains(moves, m) {
+				T.Errorf("%s: %s missing from legal moves %v\n", test.Variant, m, moves)
+			}
+		}
+		for _, m := range test.Exclude {
+			if slices.Contains(moves, m) {
+				T.Errorf("%s: %s should not be a legal move\n", test.Variant, m)
+			}
+		}
+	}
+
+	// A king promotion is sent to the engine and read back from its line
+	v, _ := LookupVariant("antichess")
+	gs, _ := NewVariantGameState(v, "8/4P3/8/8/8/8/8/k7 w - - 0 1")
+	_, extended, err := gs.ApplyAndTranslateMove("e8=K", gs.PlayerTurn)
+	if err != nil || extended != "e7e8k" {
+		T.Errorf("antichess: e8=K translated to %s (%v), expected e7e8k\n", extended, err)
+	}
+	pv, _ := GetPVMoves([]string{"info", "depth", "1", "pv", "e7e8k", "a1b1"})
+	if san, _ := gs.PVToStandard(pv); !slices.Equal(san, []string{"e8=K", "Kb1"}) {
+		T.Errorf("antichess: line e7e8k a1b1 read as %v\n", san)
+	}
+}
+
+func TestVariantAutomaticDraw(T *testing.T) {
+	tests := []struct {
+		Variant   string
+		FEN       string
+		Automatic DrawReason
+	}{
+		{Variant: "standard", FEN: "4k3/8/8/8/8/8/8/3NK3 w - - 0 1", Automatic: InsufficientMaterial},
+		{Variant: "crazyhouse", FEN: "4k3/8/8/8/8/8/8/4K3[QRBNPqrbnp] w - - 0 1", Automatic: NoDraw},
+		{Variant: "crazyhouse", FEN: "4k3/8/8/8/8/8/8/4K3[] w - - 0 1", Automatic: InsufficientMaterial},
+		{Variant: "threeCheck", FEN: "4k3/8/8/8/8/8/8/3NK3 w - - 3+3 0 1", Automatic: NoDraw},
+		{Variant: "threeCheck", FEN: "4k3/8/8/8/8/8/8/4K3 w - - 3+3 0 1", Automatic: InsufficientMaterial},
+		{Variant: "atomic", FEN: "4k3/8/8/8/8/8/8/3NK3 w - - 0 1", Automatic: NoDraw},
+		{Variant: "atomic", FEN: "4k3/8/8/8/8/8/8/4K3 w - - 0 1", Automatic: InsufficientMaterial},
+		{Variant: "antichess", FEN: "8/8/8/8/8/8/8/3NK3 w - - 0 1", Automatic: NoDraw},
+		// The stalemated black pawn wins rather than draws
+		{Variant: "antichess", FEN: "8/8/8/8/8/p7/P7/8 b - - 0 1", Automatic: NoDraw},
+		{Variant: "horde", FEN: "4k3/8/8/8/8/8/8/3B4 w - - 0 1", Automatic: NoDraw},
+		{Variant: "kingOfTheHill", FEN: "4k3/8/8/8/8/8/8/4K3 w - - 0 1", Automatic: NoDraw},
+	}
+
+	for _, test := range tests {
+		v, _ := LookupVariant(test.Variant)
+		gs, err := NewVariantGameState(v, test.FEN)
+		if err != nil {
+			T.Errorf("Unexpected error: %s\n", err.Error())
+			continue
+		}
+		if reason := gs.AutomaticDraw(); reason != test.Automatic {
+			T.Errorf("%s %s: automatic draw %q, expected %q\n", test.Variant, test.FEN, reason, test.Automatic)
+		}
+	}
+}
+
+func TestSetStatusFromVariant(T *testing.T) {
+	v, _ := LookupVariant("kingOfTheHill")
+	gs, err := NewVariantGameState(v, "4k3/8/8/8/3K4/8/8/8 b - - 1 1")
+	if err != nil {
+		T.Fatalf("Unexpected error: %s\n", err.Error())
+	}
+	game := Game{Variant: "kingOfTheHill"}
+	game.SetStatusFromState(gs)
+	if game.Status != "variantEnd" || game.Winner != "white" {
+		T.Errorf("Status %s and winner %s do not match expected: variantEnd white\n", game.Status, game.Winner)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"math/rand/v2"
+	"strings"
+)
+
+var zobristPieceOrder = []PieceType{King, Queen, Rook, Bishop, Knight, Pawn}
+
+var zobristKeys = newZobristKeys()
+
+type zobristTable struct {
+	Pieces    [2][6][64]uint64
+	Castling  [64]uint64
+	EnPassant [8]uint64
+	BlackTurn uint64
+	// Pockets is indexed by the number of that piece held
+	Pockets [2][6][17]uint64
+	Checks  [2][4]uint64
+}
+
+func newZobristKeys() (keys zobristTable) {
+	// A fixed seed keeps hashes stable between runs
+	r := rand.New(rand.NewPCG(0x6c696368616e, 0x7a6f6272697374))
+	for c := range keys.Pieces {
+		for p := range keys.Pieces[c] {
+			for s := range keys.Pieces[c][p] {
+				keys.Pieces[c][p][s] = r.Uint64()
+			}
+		}
+	}
+	for s := range keys.Castling {
+		keys.Castling[s] = r.Uint64()
+	}
+	for f := range keys.EnPassant {
+		keys.EnPassant[f] = r.Uint64()
+	}
+	keys.BlackTurn = r.Uint64()
+	for c := range keys.Pockets {
+		for p := range keys.Pockets[c] {
+			for n := range keys.Pockets[c][p] {
+				keys.Pockets[c][p][n] = r.Uint64()
+			}
+		}
+		for n := range keys.Checks[c] {
+			keys.Checks[c][n] = r.Uint64()
+		}
+	}
+	return
+}
+
+func zobristPieceIndex(pieceType PieceType) int {
+	for i, t := range zobristPieceOrder {
+		if t == pieceType {
+			return i
+		}
+	}
+	return 0
+}
+
+func countPieces(pocket []PieceType, pieceType PieceType) (n int) {
+	for _, t := range pocket {
+		if t == pieceType {
+			n++
+		}
+	}
+	return
+}
+
+func squareIndex(square string) int {
+	return int(square[0]-'a') + int(square[1]-'1')*8
+}
+
+// Hash returns the Zobrist hash of the position. Move counters and history
+// are not part of the position, so two states reached by different move
+// orders hash the same.
+func (gs *GameState) Hash() (hash uint64) {
+	for s, p := range gs.Pieces {
+		hash ^= zobristKeys.Pieces[p.PlayerColor][zobristPieceIndex(p.PieceType)][squareIndex(s)]
+	}
+	for c, pocket := range gs.Pockets {
+		for i, t := range zobristPieceOrder {
+			if n := min(countPieces(pocket, t), 16); n > 0 {
+				hash ^= zobristKeys.Pockets[c][i][n]
+			}
+		}
+	}
+	for c, n := range gs.Checks {
+		if n > 0 {
+			hash ^= zobristKeys.Checks[c][min(n, 3)]
+		}
+	}
+	for _, rookSquare := range gs.CastlingRooks {
+		hash ^= zobristKeys.Castling[squareIndex(rookSquare)]
+	}
+	if gs.enPassantCapturable() {
+		hash ^= zobristKeys.EnPassant[gs.EnPassant[0]-'a']
+	}
+	if gs.PlayerTurn == Black {
+		hash ^= zobristKeys.BlackTurn
+	}
+	return
+}
+
+// enPassantCapturable reports whether a pawn of the player to move stands
+// next to the en passant square. Positions only differ for repetition
+// purposes when the capture is actually available.
+func (gs *GameState) enPassantCapturable() bool {
+	if !squareRE.MatchString(gs.EnPassant) {
+		return false
+	}
+	file := rune(gs.EnPassant[0])
+	rank := rune(gs.EnPassant[1])
+	if gs.PlayerTurn == White {
+		rank--
+	} else {
+		rank++
+	}
+	for _, f := range []rune{file - 1, file + 1} {
+		if !strings.ContainsRune("abcdefgh", f) {
+			continue
+		}
+		if p, ok := gs.Pieces[string(f)+string(rank)]; ok &&
+			p.PieceType == Pawn &&
+			p.PlayerColor == gs.PlayerTurn {
+			return true
+		}
+	}
+	return false
+}